@@ -0,0 +1,251 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// recordSummary holds the fields that describe a record, without its payload or metadata.
+type recordSummary struct {
+	MessageId   int64      `json:"message_id"`
+	CallId      int64      `json:"call_id"`
+	StreamId    *int64     `json:"stream_id,omitempty"`
+	Type        recordType `json:"type"`
+	Direction   direction  `json:"direction,omitempty"`
+	Side        side       `json:"side,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	Time        string     `json:"time,omitempty"`
+	FullMethod  string     `json:"method,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	PeerAddr    string     `json:"peer_address,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Size        *int       `json:"size,omitempty"`
+	ContentHash string     `json:"content_hash,omitempty"`
+
+	time time.Time // Parsed from Time, zero if the record has no valid time.
+}
+
+func parseSummary(line string) recordSummary {
+	var s recordSummary
+	_ = json.Unmarshal([]byte(line), &s)
+	s.time, _ = time.Parse(time.RFC3339Nano, s.Time)
+	return s
+}
+
+// newAPIHandler returns the handler of the query API, which serves the records kept in memory by the viewer as JSON.
+//
+// - GET /api/records: summaries of the records, see recordsHandler.
+// - GET /api/records/{id}: the complete record with the given message ID.
+// - GET /api/calls/{id}: the complete records of a call or stream, in message ID order.
+// - GET /api/methods: the distinct methods in the records.
+// - GET /api/peers: the distinct peer addresses in the records.
+// - GET /api/filter: checks the CEL expression in the filter parameter, see filterHandler.
+func (v *GrpcWebViewer) newAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/records", v.recordsHandler)
+	mux.HandleFunc("GET /api/records/{id}", v.recordHandler)
+	mux.HandleFunc("GET /api/calls/{id}", v.callHandler)
+	mux.HandleFunc("GET /api/methods", v.distinctHandler("methods", func(s *recordSummary) string { return s.FullMethod }))
+	mux.HandleFunc("GET /api/peers", v.distinctHandler("peers", func(s *recordSummary) string { return s.PeerAddr }))
+	mux.HandleFunc("GET /api/filter", filterHandler)
+	return mux
+}
+
+// recordsHandler returns the summaries of the records in message ID order, one page at a time.
+//
+// The query parameters select the records:
+// - after: only the records after the given message ID.
+// - limit: the maximum number of records to return, 100 by default and at most 1000.
+// - since, until: only the records captured at or after since, and before until, in RFC 3339 format.
+// - filter: only the records matching the CEL expression, as in the web interface.
+//
+// If more records match, next_after holds the value of the after parameter for the next page.
+func (v *GrpcWebViewer) recordsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	after, ok := parseIntParam(w, query.Get("after"), 0, "message ID")
+	if !ok {
+		return
+	}
+	limit, ok := parseIntParam(w, query.Get("limit"), defaultPageSize, "limit")
+	if !ok {
+		return
+	}
+	if limit <= 0 || limit > maxPageSize {
+		http.Error(w, "Limit must be between 1 and "+strconv.Itoa(maxPageSize), http.StatusBadRequest)
+		return
+	}
+	since, ok := parseTimeParam(w, query.Get("since"))
+	if !ok {
+		return
+	}
+	until, ok := parseTimeParam(w, query.Get("until"))
+	if !ok {
+		return
+	}
+	filter, ok := parseFilterParam(w, query.Get("filter"))
+	if !ok {
+		return
+	}
+
+	records, err := v.hub.records(r.Context())
+	if err != nil {
+		return
+	}
+	page := struct {
+		Records   []*recordSummary `json:"records"`
+		NextAfter int64            `json:"next_after,omitempty"`
+	}{
+		Records: []*recordSummary{},
+	}
+	first := sort.Search(len(records), func(n int) bool { return records[n].summary.MessageId > after })
+	for i := first; i < len(records); i++ {
+		record := &records[i]
+		if !since.IsZero() && record.summary.time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !record.summary.time.Before(until) {
+			continue
+		}
+		if filter != nil && !filter.match(record.line) {
+			continue
+		}
+		if len(page.Records) == int(limit) {
+			page.NextAfter = page.Records[len(page.Records)-1].MessageId
+			break
+		}
+		page.Records = append(page.Records, &record.summary)
+	}
+	writeJSON(w, page)
+}
+
+// recordHandler returns the complete record with the given message ID.
+func (v *GrpcWebViewer) recordHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(w, r.PathValue("id"), 0, "message ID")
+	if !ok {
+		return
+	}
+	records, err := v.hub.records(r.Context())
+	if err != nil {
+		return
+	}
+	n := sort.Search(len(records), func(n int) bool { return records[n].summary.MessageId >= id })
+	if n == len(records) || records[n].summary.MessageId != id {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(records[n].line))
+}
+
+// callHandler returns the complete records of the call with the given ID.
+// The stream ID of a streaming call is the same as its call ID.
+func (v *GrpcWebViewer) callHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIntParam(w, r.PathValue("id"), 0, "call ID")
+	if !ok {
+		return
+	}
+	records, err := v.hub.records(r.Context())
+	if err != nil {
+		return
+	}
+	var call struct {
+		Records []json.RawMessage `json:"records"`
+	}
+	for _, record := range records {
+		if record.summary.CallId == id {
+			call.Records = append(call.Records, json.RawMessage(record.line))
+		}
+	}
+	if len(call.Records) == 0 {
+		http.Error(w, "Call not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, call)
+}
+
+// filterHandler checks the filter expression of the web interface before it is applied by the viewer.
+// It returns no content if the expression is valid, and the error of the expression with status 400 otherwise.
+func filterHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := parseFilterParam(w, r.URL.Query().Get("filter")); ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// distinctHandler returns a handler listing the distinct non-empty values of a field of the records, in sorted order.
+func (v *GrpcWebViewer) distinctHandler(name string, field func(*recordSummary) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		records, err := v.hub.records(r.Context())
+		if err != nil {
+			return
+		}
+		seen := make(map[string]struct{})
+		values := []string{}
+		for i := range records {
+			value := field(&records[i].summary)
+			if _, ok := seen[value]; ok || value == "" {
+				continue
+			}
+			seen[value] = struct{}{}
+			values = append(values, value)
+		}
+		slices.Sort(values)
+		writeJSON(w, map[string][]string{name: values})
+	}
+}
+
+// parseIntParam parses a non-negative integer parameter, returning the default if it is empty.
+// It responds with an error and returns false if the parameter is invalid.
+func parseIntParam(w http.ResponseWriter, s string, def int64, name string) (int64, bool) {
+	if s == "" {
+		return def, true
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		http.Error(w, "Invalid "+name+": "+s, http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+// parseTimeParam parses a time parameter in RFC 3339 format, returning the zero time if it is empty.
+// It responds with an error and returns false if the parameter is invalid.
+func parseTimeParam(w http.ResponseWriter, s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		http.Error(w, "Invalid time: "+s, http.StatusBadRequest)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// parseFilterParam compiles a CEL filter parameter, returning nil if it is empty.
+// It responds with an error and returns false if the expression is invalid.
+func parseFilterParam(w http.ResponseWriter, s string) (*recordFilter, bool) {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil, true
+	}
+	filter, err := newRecordFilter(s)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return filter, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,135 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var apiTestTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// apiTestRecord returns a record of the API tests: two records per call, alternating between two methods and peers.
+func apiTestRecord(id int) string {
+	call := (id + 1) / 2
+	method, peer, direction := "/a.A/Call", "10.0.0.1:1000", "send"
+	if call%2 == 0 {
+		method, peer = "/b.B/Call", "10.0.0.2:2000"
+	}
+	if id%2 == 0 {
+		direction = "recv"
+	}
+	return fmt.Sprintf(`{"message_id":%d,"call_id":%d,"type":"message","direction":%q,"time":%q,"method":%q,"peer_address":%q,"content":{"id":%d}}`,
+		id, call, direction, apiTestTime.Add(time.Duration(id)*time.Second).Format(time.RFC3339Nano), method, peer, id)
+}
+
+func newAPITestViewer(t *testing.T) *GrpcWebViewer {
+	t.Helper()
+	ring := NewRingSink(100, 0)
+	_ = ring.writePinned([]byte(`{"type":"capture"}`))
+	for id := 1; id <= 10; id++ {
+		_ = ring.Write([]byte(apiTestRecord(id)))
+	}
+	v := NewRingWebViewer("", ring)
+	t.Cleanup(func() { _ = v.Shutdown(t.Context()) })
+	return v
+}
+
+func TestRecordsHandler(t *testing.T) {
+	v := newAPITestViewer(t)
+	at := func(seconds int) string {
+		return apiTestTime.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		query         string
+		wantStatus    int
+		wantIds       []int64
+		wantNextAfter int64
+	}{
+		{"", http.StatusOK, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 0},
+		{"?limit=3", http.StatusOK, []int64{1, 2, 3}, 3},
+		{"?after=3&limit=3", http.StatusOK, []int64{4, 5, 6}, 6},
+		{"?after=5&limit=5", http.StatusOK, []int64{6, 7, 8, 9, 10}, 0},
+		{"?after=9&limit=3", http.StatusOK, []int64{10}, 0},
+		{"?after=10", http.StatusOK, []int64{}, 0},
+		{"?since=" + at(3) + "&until=" + at(6), http.StatusOK, []int64{3, 4, 5}, 0},
+		{"?since=" + at(3) + "&limit=2", http.StatusOK, []int64{3, 4}, 4},
+		{"?until=" + at(2), http.StatusOK, []int64{1}, 0},
+		{"?filter=direction+%3D%3D+%27recv%27&limit=2", http.StatusOK, []int64{2, 4}, 4},
+		{"?filter=direction+%3D%3D+%27recv%27&after=4&limit=2", http.StatusOK, []int64{6, 8}, 8},
+		{"?filter=content.id+%3E+8", http.StatusOK, []int64{9, 10}, 0},
+		{"?limit=0", http.StatusBadRequest, nil, 0},
+		{"?limit=1001", http.StatusBadRequest, nil, 0},
+		{"?limit=x", http.StatusBadRequest, nil, 0},
+		{"?after=-1", http.StatusBadRequest, nil, 0},
+		{"?since=yesterday", http.StatusBadRequest, nil, 0},
+		{"?filter=bogus+%3D%3D+1", http.StatusBadRequest, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := serve(t, v, http.MethodGet, "/api/records"+tt.query)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var page struct {
+				Records []struct {
+					MessageId int64 `json:"message_id"`
+				} `json:"records"`
+				NextAfter int64 `json:"next_after"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			ids := []int64{}
+			for _, r := range page.Records {
+				ids = append(ids, r.MessageId)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIds) {
+				t.Errorf("got records %v, want %v", ids, tt.wantIds)
+			}
+			if page.NextAfter != tt.wantNextAfter {
+				t.Errorf("got next_after %d, want %d", page.NextAfter, tt.wantNextAfter)
+			}
+		})
+	}
+}
+
+func TestRecordAndCallHandlers(t *testing.T) {
+	v := newAPITestViewer(t)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/api/records/4", http.StatusOK, apiTestRecord(4) + "\n"},
+		{"/api/records/11", http.StatusNotFound, "Record not found\n"},
+		{"/api/records/x", http.StatusBadRequest, "Invalid message ID: x\n"},
+		{"/api/calls/2", http.StatusOK, `{"records":[` + apiTestRecord(3) + "," + apiTestRecord(4) + "]}\n"},
+		{"/api/calls/6", http.StatusNotFound, "Call not found\n"},
+		{"/api/calls/x", http.StatusBadRequest, "Invalid call ID: x\n"},
+		{"/api/methods", http.StatusOK, `{"methods":["/a.A/Call","/b.B/Call"]}` + "\n"},
+		{"/api/peers", http.StatusOK, `{"peers":["10.0.0.1:1000","10.0.0.2:2000"]}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(t, v, http.MethodGet, tt.path)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("got body %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+
+	if rec := serve(t, v, http.MethodPost, "/api/records"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for POST, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,215 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// sharedCapture is a capture file, or a set of sinks, written by one or more interceptors.
+//
+// Interceptors configured with the same file share the capture, for example the server and client interceptors
+// of a process that is both. The records of all of them get unique message and call IDs from the shared
+// writer and are served by a single web viewer. The capture is closed when the last interceptor is closed.
+type sharedCapture struct {
+	key      string // Absolute path of the capture file, empty if the capture is not shared.
+	writer   *captureWriter
+	fileSink *FileSink // The file configured with WithFilename, nil if none.
+	ring     *RingSink // Records kept in memory, served by the web viewer if there is no file.
+	viewer   *GrpcWebViewer
+	callId   atomic.Int64 // Unique identifier for each call.
+	refs     int          // Number of interceptors using the capture, guarded by captures.mu.
+
+	mu      sync.Mutex
+	members []*GrpcJsonInterceptor // Interceptors writing to the capture, in the order they were created.
+}
+
+// captures holds the shared captures of the process, by the absolute path of the capture file.
+var captures = struct {
+	mu    sync.Mutex
+	files map[string]*sharedCapture
+}{files: make(map[string]*sharedCapture)}
+
+// acquireCapture returns the capture configured by the options, creating it if no other interceptor is writing to the file.
+// It returns nil if no sink is configured.
+// Each acquired capture must be released with leave.
+//
+// The sinks, rotation and writer of a shared capture are configured by the first interceptor.
+// The web viewer is started by the first interceptor with an address.
+// A listener given in the options is closed if the web viewer does not take it over.
+func acquireCapture(opts *grpcJsonInterceptorOptions) (*sharedCapture, error) {
+	captures.mu.Lock()
+	defer captures.mu.Unlock()
+	defer func() {
+		if opts.Listener != nil {
+			_ = opts.Listener.Close()
+		}
+	}()
+
+	if opts.Filename == "" {
+		c, err := newCapture(opts, "")
+		if c != nil {
+			c.refs++
+		}
+		return c, err
+	}
+	key, err := filepath.Abs(opts.Filename)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := captures.files[key]
+	if !ok {
+		c, err = newCapture(opts, key)
+		if err != nil {
+			return nil, err
+		}
+		c.refs++
+		captures.files[key] = c
+		return c, nil
+	}
+
+	if len(opts.Sinks) > 0 {
+		return nil, fmt.Errorf("capture %s is already open, sinks can be added only by the first interceptor writing to it", opts.Filename)
+	}
+	if c.viewer == nil {
+		if err := c.startViewer(opts); err != nil {
+			return nil, err
+		}
+	}
+	c.refs++
+	return c, nil
+}
+
+func newCapture(opts *grpcJsonInterceptorOptions, key string) (*sharedCapture, error) {
+	sinks := opts.Sinks
+	if opts.MemoryBuffer != nil {
+		sinks = append(sinks, opts.MemoryBuffer)
+	}
+	var fileSink *FileSink
+	if opts.Filename != "" {
+		var err error
+		fileSink, err = NewRotatingFileSink(opts.Filename, opts.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append([]Sink{fileSink}, sinks...)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	var sink Sink
+	if len(sinks) == 1 {
+		sink = sinks[0]
+	} else {
+		sink = NewMultiSink(sinks...)
+	}
+
+	c := &sharedCapture{
+		key:      key,
+		writer:   newCaptureWriter(sink, opts.QueueSize, opts.OverflowPolicy),
+		fileSink: fileSink,
+		ring:     opts.MemoryBuffer,
+	}
+	// Without a memory buffer, the web viewer can serve a ring given as a sink.
+	for _, sink := range sinks {
+		if ring, ok := sink.(*RingSink); ok && c.ring == nil {
+			c.ring = ring
+		}
+	}
+	if err := c.startViewer(opts); err != nil {
+		_ = c.writer.close(context.Background())
+		return nil, err
+	}
+	return c, nil
+}
+
+// startViewer starts the web viewer, if the options have an address for it.
+// The web viewer reads the captured messages back from the file, or from the ring if there is no file.
+// The address is bound here, so that an address already in use is reported to the caller.
+// A listener given in the options is taken over by the web viewer, and cleared from the options.
+func (c *sharedCapture) startViewer(opts *grpcJsonInterceptorOptions) error {
+	if opts.Addr == "" && opts.Listener == nil {
+		return nil
+	}
+	if c.fileSink == nil && c.ring == nil {
+		if opts.Listener != nil {
+			return errors.New("web viewer listener requires a filename or a memory buffer")
+		}
+		return nil
+	}
+	listener := opts.Listener
+	opts.Listener = nil
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", opts.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.fileSink != nil {
+		c.viewer = NewGrpcWebViewer(listener.Addr().String(), opts.Filename, opts.ViewerOptions...)
+	} else {
+		c.viewer = NewRingWebViewer(listener.Addr().String(), c.ring, opts.ViewerOptions...)
+	}
+	c.viewer.capture = c
+	go func() {
+		if err := c.viewer.ServeListener(listener); err != nil {
+			log.Printf("grpc-json-sniffer: web viewer stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// join adds the interceptor to the capture.
+func (c *sharedCapture) join(i *GrpcJsonInterceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members = append(c.members, i)
+}
+
+// leave removes the interceptor from the capture.
+// When the last interceptor leaves, the web viewer is stopped, the remaining messages are written and the sinks closed.
+func (c *sharedCapture) leave(ctx context.Context, i *GrpcJsonInterceptor) error {
+	c.mu.Lock()
+	n := slices.Index(c.members, i)
+	if n < 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	c.members = slices.Delete(c.members, n, n+1)
+	c.mu.Unlock()
+
+	// The registry lock keeps a new interceptor from joining a capture that is being closed.
+	captures.mu.Lock()
+	c.refs--
+	last := c.refs == 0
+	if last && c.key != "" {
+		delete(captures.files, c.key)
+	}
+	captures.mu.Unlock()
+	if !last {
+		return nil
+	}
+
+	var errs []error
+	if c.viewer != nil {
+		errs = append(errs, c.viewer.Shutdown(ctx))
+	}
+	errs = append(errs, c.writer.close(ctx))
+	return errors.Join(errs...)
+}
+
+// interceptors returns the interceptors writing to the capture.
+func (c *sharedCapture) interceptors() []*GrpcJsonInterceptor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.members)
+}
@@ -0,0 +1,66 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func assertClosed(t *testing.T, l net.Listener) {
+	t.Helper()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("listener was not closed: %v", err)
+	}
+}
+
+func TestListenerClosedWhenUnused(t *testing.T) {
+	t.Setenv("GRPC_JSON_SNIFFER_FILE", "")
+	t.Setenv("GRPC_JSON_SNIFFER_ADDR", "")
+
+	t.Run("no sink", func(t *testing.T) {
+		l := listen(t)
+		i, err := NewGrpcJsonInterceptor(WithListener(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i.Close(context.Background()) //nolint:errcheck
+		assertClosed(t, l)
+	})
+
+	t.Run("only custom sinks", func(t *testing.T) {
+		l := listen(t)
+		if _, err := NewGrpcJsonInterceptor(WithSink(NewMemorySink()), WithListener(l)); err == nil {
+			t.Error("no error for a listener without a file or a memory buffer")
+		}
+		assertClosed(t, l)
+	})
+
+	t.Run("shared capture", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "capture.json")
+		first := listen(t)
+		i1, err := NewGrpcJsonInterceptor(WithFilename(filename), WithListener(first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i1.Close(context.Background()) //nolint:errcheck
+
+		second := listen(t)
+		i2, err := NewGrpcJsonInterceptor(WithFilename(filename), WithListener(second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer i2.Close(context.Background()) //nolint:errcheck
+		assertClosed(t, second)
+	})
+}
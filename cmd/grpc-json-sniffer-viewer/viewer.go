@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	sniffer "github.com/tsaarni/grpc-json-sniffer"
 )
 
 func main() {
 	addr := flag.String("addr", "localhost:8080", "Address to serve the web viewer")
+	traceURL := flag.String("trace-url", os.Getenv("GRPC_JSON_SNIFFER_TRACE_URL"), "URL template linking trace IDs to a tracing UI, e.g. http://localhost:16686/trace/{trace_id}")
+	maxRecords := flag.Int("max-records", 100000, "Number of latest records kept in memory for the web clients")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s -addr <address> <path>\n", os.Args[0])
 		flag.PrintDefaults()
@@ -33,7 +39,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	viewer := sniffer.NewGrpcWebViewer(*addr, messagesFile)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	viewer := sniffer.NewGrpcWebViewer(*addr, messagesFile, sniffer.WithTraceURL(*traceURL), sniffer.WithMaxRecords(*maxRecords))
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = viewer.Shutdown(shutdownCtx)
+	}()
+
 	fmt.Printf("Starting gRPC JSON sniffer viewer on %s\n", *addr)
-	viewer.Serve()
+	if err := viewer.Serve(); err != nil {
+		fmt.Printf("Failed to serve: %v\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,171 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// Enable starts capturing new calls.
+// It has no effect if the interceptor has no sink configured.
+func (i *GrpcJsonInterceptor) Enable() {
+	if i.writer == nil {
+		return
+	}
+	i.enabled.Store(true)
+}
+
+// Disable stops capturing new calls.
+// Calls that started while the capture was enabled are captured until they end.
+func (i *GrpcJsonInterceptor) Disable() {
+	i.enabled.Store(false)
+}
+
+// Enabled returns true if new calls are captured.
+func (i *GrpcJsonInterceptor) Enabled() bool {
+	return i.enabled.Load()
+}
+
+// SetCaptureRules replaces the capture rules, see WithCaptureRules.
+// The new rules apply to calls that start after the change.
+func (i *GrpcJsonInterceptor) SetCaptureRules(rules ...CaptureRule) {
+	i.rules.Store(newRuleSet(rules))
+}
+
+// CaptureRules returns the capture rules in effect.
+func (i *GrpcJsonInterceptor) CaptureRules() []CaptureRule {
+	rs := i.rules.Load()
+	if rs == nil {
+		return nil
+	}
+	return append([]CaptureRule(nil), rs.rules...)
+}
+
+// RotateCapture starts a fresh capture file.
+// The current file is moved aside as if it was rotated, see Rotation.
+// It returns an error if no file is configured.
+func (i *GrpcJsonInterceptor) RotateCapture() error {
+	if i.fileSink == nil {
+		return errors.New("no capture file configured")
+	}
+	return i.fileSink.Rotate()
+}
+
+// watchToggleSignal toggles the capture each time the signal is received.
+// It returns a function that stops watching.
+func (i *GrpcJsonInterceptor) watchToggleSignal(sig os.Signal) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, sig)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if i.Enabled() {
+					i.Disable()
+				} else {
+					i.Enable()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// captureControl is the state of the capture, as returned and accepted by the control endpoint of the web viewer.
+type captureControl struct {
+	Enabled *bool         `json:"enabled,omitempty"`
+	Rules   *string       `json:"rules,omitempty"`  // Rules in the syntax of ParseCaptureRules.
+	Rotate  bool          `json:"rotate,omitempty"` // Start a fresh capture file, only in requests.
+	Stats   *CaptureStats `json:"stats,omitempty"`  // Only in responses.
+}
+
+// controlHandler serves the runtime control of the capture.
+//
+// GET returns the state of the capture.
+// POST changes the fields present in the JSON request body and returns the new state.
+// If the request fails, none of the changes are made.
+// The request must have the content type application/json, which browsers do not send cross-origin
+// without the consent of the server.
+// Changes apply to all interceptors writing to the capture, and the state of the first one is returned.
+func (v *GrpcWebViewer) controlHandler(w http.ResponseWriter, r *http.Request) {
+	var interceptors []*GrpcJsonInterceptor
+	if v.capture != nil {
+		interceptors = v.capture.interceptors()
+	}
+	if len(interceptors) == 0 {
+		http.Error(w, "Capture control is not available", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req captureControl
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The request is validated and the file rotated before anything is changed,
+		// so that a failed request leaves the capture as it was.
+		var rules []CaptureRule
+		if req.Rules != nil {
+			var err error
+			rules, err = ParseCaptureRules(*req.Rules)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Rotate {
+			// The interceptors share the file, it is rotated once.
+			if err := interceptors[0].RotateCapture(); err != nil {
+				http.Error(w, "Cannot rotate capture, no changes were made: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		for _, i := range interceptors {
+			if req.Rules != nil {
+				i.SetCaptureRules(rules...)
+			}
+			if req.Enabled != nil {
+				if *req.Enabled {
+					i.Enable()
+				} else {
+					i.Disable()
+				}
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	i := interceptors[0]
+	enabled := i.Enabled()
+	var rules []string
+	for _, rule := range i.CaptureRules() {
+		rules = append(rules, rule.String())
+	}
+	joined := strings.Join(rules, "; ")
+	stats := i.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(captureControl{
+		Enabled: &enabled,
+		Rules:   &joined,
+		Stats:   &stats,
+	})
+}
@@ -0,0 +1,85 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlHandler(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "capture.json")
+	i, err := NewGrpcJsonInterceptor(WithFilename(filename), WithListener(listen(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close(context.Background()) //nolint:errcheck
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/control", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		i.capture.viewer.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		setup       func()
+		wantStatus  int
+		wantEnabled bool
+		wantRules   int
+	}{
+		{
+			name:        "invalid rules",
+			body:        `{"enabled": false, "rules": "bogus"}`,
+			wantStatus:  http.StatusBadRequest,
+			wantEnabled: true,
+		},
+		{
+			name: "failed rotation",
+			body: `{"enabled": false, "rules": "exclude method=/a/*", "rotate": true}`,
+			setup: func() {
+				// The file cannot be rotated if it is no longer at its path.
+				if err := os.Rename(filename, filename+".moved"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus:  http.StatusInternalServerError,
+			wantEnabled: true,
+		},
+		{
+			name: "all changes",
+			body: `{"enabled": false, "rules": "exclude method=/a/*", "rotate": true}`,
+			setup: func() {
+				if err := os.Rename(filename+".moved", filename); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus:  http.StatusOK,
+			wantEnabled: false,
+			wantRules:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			rec := post(tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if i.Enabled() != tt.wantEnabled {
+				t.Errorf("got enabled %v, want %v", i.Enabled(), tt.wantEnabled)
+			}
+			if got := len(i.CaptureRules()); got != tt.wantRules {
+				t.Errorf("got %d rules, want %d", got, tt.wantRules)
+			}
+		})
+	}
+}
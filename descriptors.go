@@ -0,0 +1,209 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// captureFormatVersion is the version of the capture file format, written in the capture header.
+// It is incremented when the format changes in a way that is not backwards compatible.
+const captureFormatVersion = 1
+
+// captureHeader is the first record of every capture file.
+//
+// It describes the process that wrote the capture, and holds the descriptors of all message types
+// written so far, so that a file started by rotation can be decoded on its own.
+type captureHeader struct {
+	Type          recordType      `json:"type"`
+	FormatVersion int             `json:"format_version"`
+	Time          string          `json:"time"`
+	Process       processInfo     `json:"process"`
+	Descriptors   json.RawMessage `json:"descriptors,omitempty"` // google.protobuf.FileDescriptorSet
+}
+
+// descriptorsRecord holds the descriptors of message types that are written to the capture for the first time.
+// It is written just before the first record that uses the types.
+type descriptorsRecord struct {
+	Type        recordType      `json:"type"`
+	Time        string          `json:"time"`
+	Descriptors json.RawMessage `json:"descriptors"` // google.protobuf.FileDescriptorSet
+}
+
+// processInfo identifies the process that wrote the capture.
+type processInfo struct {
+	Pid           int    `json:"pid"`
+	Executable    string `json:"executable,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	GoVersion     string `json:"go_version"`
+	Module        string `json:"module,omitempty"`
+	ModuleVersion string `json:"module_version,omitempty"`
+	StartTime     string `json:"start_time"`
+}
+
+func newProcessInfo() processInfo {
+	p := processInfo{
+		Pid:       os.Getpid(),
+		GoVersion: runtime.Version(),
+		StartTime: time.Now().Format(time.RFC3339Nano),
+	}
+	p.Executable, _ = os.Executable()
+	p.Hostname, _ = os.Hostname()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		p.Module = info.Main.Path
+		p.ModuleVersion = info.Main.Version
+	}
+	return p
+}
+
+// descriptorSet collects the file descriptors of the message types written to the capture.
+// It is used only by the writer goroutine.
+type descriptorSet struct {
+	messages map[protoreflect.FullName]bool
+	files    map[string]bool
+	all      []*descriptorpb.FileDescriptorProto // In dependency order.
+}
+
+func newDescriptorSet() *descriptorSet {
+	return &descriptorSet{
+		messages: make(map[protoreflect.FullName]bool),
+		files:    make(map[string]bool),
+	}
+}
+
+// add adds the files defining the message types, and the files they import.
+// It returns the files that were not in the set before, each file after its dependencies.
+func (d *descriptorSet) add(types []protoreflect.MessageDescriptor) []*descriptorpb.FileDescriptorProto {
+	var added []*descriptorpb.FileDescriptorProto
+	for _, md := range types {
+		if d.messages[md.FullName()] {
+			continue
+		}
+		d.messages[md.FullName()] = true
+		added = d.addFile(md.ParentFile(), added)
+	}
+	return added
+}
+
+func (d *descriptorSet) addFile(fd protoreflect.FileDescriptor, added []*descriptorpb.FileDescriptorProto) []*descriptorpb.FileDescriptorProto {
+	if fd == nil || fd.IsPlaceholder() || d.files[fd.Path()] {
+		return added
+	}
+	d.files[fd.Path()] = true
+
+	imports := fd.Imports()
+	for n := 0; n < imports.Len(); n++ {
+		added = d.addFile(imports.Get(n).FileDescriptor, added)
+	}
+
+	file := protodesc.ToFileDescriptorProto(fd)
+	d.all = append(d.all, file)
+	return append(added, file)
+}
+
+// marshalDescriptors encodes the files as a google.protobuf.FileDescriptorSet in JSON.
+// The descriptors use the default protojson encoding, independent of how the messages are encoded.
+func marshalDescriptors(files []*descriptorpb.FileDescriptorProto) (json.RawMessage, error) {
+	return protojson.Marshal(&descriptorpb.FileDescriptorSet{File: files})
+}
+
+// typeCollector finds the message types used by a message, including the contents of google.protobuf.Any
+// fields, which are not visible in the descriptor of the message.
+type typeCollector struct {
+	resolver protoregistry.MessageTypeResolver
+
+	// Cache of message types that contain Any fields, directly or in nested messages.
+	containsAny sync.Map // protoreflect.FullName -> bool
+}
+
+func newTypeCollector(resolver protoregistry.MessageTypeResolver) *typeCollector {
+	if resolver == nil {
+		resolver = protoregistry.GlobalTypes
+	}
+	return &typeCollector{resolver: resolver}
+}
+
+const anyFullName protoreflect.FullName = "google.protobuf.Any"
+
+// collect returns the type of the message and the types packed in its Any fields.
+// Types that the resolver does not know are skipped.
+func (t *typeCollector) collect(m protoreflect.Message) []protoreflect.MessageDescriptor {
+	types := []protoreflect.MessageDescriptor{m.Descriptor()}
+	if t.messageContainsAny(m.Descriptor()) {
+		types = t.collectAny(m, types)
+	}
+	return types
+}
+
+func (t *typeCollector) collectAny(m protoreflect.Message, types []protoreflect.MessageDescriptor) []protoreflect.MessageDescriptor {
+	if m.Descriptor().FullName() == anyFullName {
+		url := m.Get(m.Descriptor().Fields().ByName("type_url")).String()
+		if mt, err := t.resolver.FindMessageByURL(url); err == nil {
+			types = append(types, mt.Descriptor())
+		}
+		return types
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil && t.messageContainsAny(fd.MapValue().Message()) {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					types = t.collectAny(v.Message(), types)
+					return true
+				})
+			}
+		case fd.Message() != nil && t.messageContainsAny(fd.Message()):
+			if fd.IsList() {
+				list := v.List()
+				for n := 0; n < list.Len(); n++ {
+					types = t.collectAny(list.Get(n).Message(), types)
+				}
+			} else {
+				types = t.collectAny(v.Message(), types)
+			}
+		}
+		return true
+	})
+	return types
+}
+
+func (t *typeCollector) messageContainsAny(md protoreflect.MessageDescriptor) bool {
+	if contains, ok := t.containsAny.Load(md.FullName()); ok {
+		return contains.(bool)
+	}
+	contains := containsAny(md, map[protoreflect.FullName]bool{})
+	t.containsAny.Store(md.FullName(), contains)
+	return contains
+}
+
+func containsAny(md protoreflect.MessageDescriptor, visited map[protoreflect.FullName]bool) bool {
+	if md.FullName() == anyFullName {
+		return true
+	}
+	if visited[md.FullName()] {
+		return false
+	}
+	visited[md.FullName()] = true
+
+	fields := md.Fields()
+	for n := 0; n < fields.Len(); n++ {
+		fd := fields.Get(n)
+		if fd.IsMap() {
+			fd = fd.MapValue()
+		}
+		if fd.Message() != nil && containsAny(fd.Message(), visited) {
+			return true
+		}
+	}
+	return false
+}
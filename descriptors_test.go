@@ -0,0 +1,138 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/tsaarni/grpc-json-sniffer/example/demo"
+)
+
+func messageRecord(msg proto.Message) *capturedMessage {
+	md := msg.ProtoReflect().Descriptor()
+	return &capturedMessage{
+		Type:         recordMessage,
+		Message:      string(md.FullName()),
+		messageTypes: []protoreflect.MessageDescriptor{md},
+	}
+}
+
+// captureFile describes the records of a capture file.
+type captureFile struct {
+	records     []string // Types of the records, and the message type of message records.
+	defined     []string // Messages whose types were defined before them.
+	unknown     []string // Messages whose types were not defined before them.
+	headerFiles []string // Files described in the capture header.
+}
+
+// readCaptureFile checks which messages of a capture file can be decoded with the descriptors before them.
+func readCaptureFile(t *testing.T, name string) captureFile {
+	t.Helper()
+	var f captureFile
+	types := map[string]bool{}
+	addTypes := func(descriptors json.RawMessage) []string {
+		var set descriptorpb.FileDescriptorSet
+		if err := protojson.Unmarshal(descriptors, &set); err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, file := range set.GetFile() {
+			files = append(files, file.GetName())
+			for _, m := range file.GetMessageType() {
+				types[file.GetPackage()+"."+m.GetName()] = true
+			}
+		}
+		return files
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(readFile(t, name)), "\n") {
+		var r struct {
+			Type        recordType      `json:"type"`
+			Message     string          `json:"message"`
+			Descriptors json.RawMessage `json:"descriptors"`
+		}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		f.records = append(f.records, strings.TrimSpace(string(r.Type)+" "+r.Message))
+		switch r.Type {
+		case recordCapture:
+			if r.Descriptors != nil {
+				f.headerFiles = addTypes(r.Descriptors)
+			}
+		case recordDescriptors:
+			addTypes(r.Descriptors)
+		case recordMessage:
+			if types[r.Message] {
+				f.defined = append(f.defined, r.Message)
+			} else {
+				f.unknown = append(f.unknown, r.Message)
+			}
+		}
+	}
+	return f
+}
+
+func TestDescriptorsBeforeRecords(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "capture.json")
+	sink, err := NewFileSink(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newCaptureWriter(sink, 0, OverflowBlock)
+
+	w.enqueue(messageRecord(&demo.HelloRequest{}))
+	w.enqueue(messageRecord(&demo.HelloRequest{}))
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	// The type from the same file is defined by the header of the new file, the other one by a new descriptors record.
+	w.enqueue(messageRecord(&demo.HelloReply{}))
+	w.enqueue(messageRecord(&errdetails.BadRequest{}))
+	if err := w.close(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "capture-*.json"))
+	if len(rotated) != 1 {
+		t.Fatalf("got rotated files %v, want one", rotated)
+	}
+
+	tests := []struct {
+		name string
+		want captureFile
+	}{
+		{
+			name: rotated[0],
+			want: captureFile{
+				records: []string{"capture", "descriptors", "message demo.HelloRequest", "message demo.HelloRequest"},
+				defined: []string{"demo.HelloRequest", "demo.HelloRequest"},
+			},
+		},
+		{
+			name: filename,
+			want: captureFile{
+				records:     []string{"capture", "message demo.HelloReply", "descriptors", "message google.rpc.BadRequest"},
+				defined:     []string{"demo.HelloReply", "google.rpc.BadRequest"},
+				headerFiles: []string{"example/demo/demo.proto"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := readCaptureFile(t, tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", filepath.Base(tt.name), got, tt.want)
+		}
+	}
+}
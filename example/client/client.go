@@ -38,6 +38,8 @@ func main() {
 		slog.Error("failed to create capture interceptor", "error", err)
 		return
 	}
+	// Write the remaining captured messages before exiting.
+	defer interceptor.Close(context.Background()) //nolint:errcheck
 
 	conn, err := grpc.NewClient(grpcServerAddress,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	grpc_json_sniffer "github.com/tsaarni/grpc-json-sniffer"
@@ -69,9 +72,23 @@ func main() {
 	s := grpc.NewServer(opts...)
 	demo.RegisterDemoServer(s, &server{})
 
+	// Stop gracefully on interrupt, so that all captured messages are written to the file.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+
 	fmt.Printf("gRPC server is running on %s\n", grpcAddress)
 	fmt.Printf("HTTP server is running on %s\n", httpViewerAddress)
 	if err := s.Serve(listener); err != nil {
 		slog.Error("failed to serve", "error", err)
 	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := interceptor.Close(closeCtx); err != nil {
+		slog.Error("failed to close capture interceptor", "error", err)
+	}
 }
@@ -0,0 +1,157 @@
+package grpc_json_sniffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+)
+
+// filterVariables are the record fields available in filter expressions, the same as in the web interface.
+var filterVariables = []struct {
+	name string
+	typ  *cel.Type
+}{
+	{"message_id", cel.DynType},
+	{typeVariable, cel.StringType},
+	{"call_id", cel.DynType},
+	{"stream_id", cel.DynType},
+	{"trace_id", cel.StringType},
+	{"span_id", cel.StringType},
+	{"direction", cel.StringType},
+	{"side", cel.StringType},
+	{"source", cel.StringType},
+	{"time", cel.StringType},
+	{"method", cel.StringType},
+	{"message", cel.StringType},
+	{"peer_address", cel.StringType},
+	{"content", cel.DynType},
+	{"metadata", cel.DynType},
+	{"error", cel.StringType},
+	{"status", cel.DynType},
+	{"deadline", cel.StringType},
+	{"timeout_ms", cel.DynType},
+	{"duration_ms", cel.DynType},
+	{"messages_sent", cel.DynType},
+	{"messages_received", cel.DynType},
+	{"cause", cel.StringType},
+	{"elapsed_ms", cel.DynType},
+	{"raw", cel.StringType},
+	{"codec", cel.StringType},
+	{"marshal_error", cel.StringType},
+	{"size", cel.DynType},
+	{"content_hash", cel.StringType},
+	{"truncated", cel.DynType},
+	{"content_omitted", cel.BoolType},
+	{"payload_length", cel.DynType},
+	{"compressed_length", cel.DynType},
+	{"wire_length", cel.DynType},
+	{"compression", cel.StringType},
+	{"attempt", cel.DynType},
+	{"transparent_retry", cel.BoolType},
+}
+
+// typeVariable holds the type of the record.
+// CEL reserves the name type for the type of types, so the identifier is renamed in the expressions.
+const typeVariable = "record_type"
+
+var filterEnv = sync.OnceValues(func() (*cel.Env, error) {
+	var options []cel.EnvOption
+	for _, v := range filterVariables {
+		options = append(options, cel.Variable(v.name, v.typ))
+	}
+	return cel.NewEnv(options...)
+})
+
+// recordFilter selects the records sent to a web client with a CEL expression.
+type recordFilter struct {
+	program cel.Program
+}
+
+// newRecordFilter compiles the filter expression.
+// It returns an error if the expression is invalid or does not evaluate to a boolean.
+func newRecordFilter(expr string) (*recordFilter, error) {
+	env, err := filterEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Parse(expr)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	celast.PreOrderVisit(ast.NativeRep().Expr(), celast.NewExprVisitor(func(e celast.Expr) {
+		if e.Kind() == celast.IdentKind && e.AsIdent() == "type" {
+			e.SetKindCase(celast.NewExprFactory().NewIdent(e.ID(), typeVariable))
+		}
+	}))
+	ast, issues = env.Check(ast)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if t := ast.OutputType(); !t.IsExactType(cel.BoolType) && !t.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("filter must evaluate to a bool, not %s", t)
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &recordFilter{program: program}, nil
+}
+
+// match returns true if the record matches the filter.
+//
+// The capture header and the descriptors always match, since they are needed to decode the other records.
+// A record that cannot be evaluated, for example because it lacks a field used by the expression, does not match.
+func (f *recordFilter) match(line string) bool {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+	decoder.UseNumber()
+	var record map[string]any
+	if err := decoder.Decode(&record); err != nil {
+		return false
+	}
+	if t := record["type"]; t == string(recordCapture) || t == string(recordDescriptors) {
+		return true
+	}
+	if t, ok := record["type"]; ok {
+		record[typeVariable] = t
+	}
+
+	result, _, err := f.program.Eval(filterActivation(record))
+	if err != nil {
+		return false
+	}
+	matched, ok := result.Value().(bool)
+	return ok && matched
+}
+
+// filterActivation converts the decoded record to CEL values.
+// Integral JSON numbers become integers, so that they compare equal to integer literals such as call_id == 3.
+func filterActivation(record map[string]any) map[string]any {
+	for name, value := range record {
+		record[name] = filterValue(value)
+	}
+	return record
+}
+
+func filterValue(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		n, _ := v.Float64()
+		return n
+	case map[string]any:
+		return filterActivation(v)
+	case []any:
+		for i := range v {
+			v[i] = filterValue(v[i])
+		}
+		return v
+	default:
+		return value
+	}
+}
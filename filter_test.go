@@ -0,0 +1,141 @@
+package grpc_json_sniffer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRecordFilter(t *testing.T) {
+	const (
+		header  = `{"type":"capture","version":1}`
+		end     = `{"message_id":4,"call_id":1,"type":"end","duration_ms":1500,"status":{"code":14,"code_name":"UNAVAILABLE"}}`
+		quick   = `{"message_id":5,"call_id":2,"type":"end","duration_ms":20,"status":{"code":0,"code_name":"OK"}}`
+		message = `{"message_id":2,"call_id":1,"type":"message","direction":"recv","content":{"value":7,"ratio":0.5,"name":"a"}}`
+	)
+
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr string
+		match   []string
+		noMatch []string
+	}{
+		{
+			name:    "type is renamed",
+			expr:    `type == 'end' && duration_ms > 1000`,
+			match:   []string{end},
+			noMatch: []string{quick, message},
+		},
+		{
+			name:    "renamed variable",
+			expr:    `record_type == 'message'`,
+			match:   []string{message},
+			noMatch: []string{end},
+		},
+		{
+			name:    "nested field",
+			expr:    `status.code == 14`,
+			match:   []string{end},
+			noMatch: []string{quick},
+		},
+		{
+			name:    "content",
+			expr:    `content.value > 5 && content.ratio < 1.0 && content.name == 'a'`,
+			match:   []string{message},
+			noMatch: []string{`{"message_id":3,"type":"message","content":{"value":3,"ratio":0.5,"name":"a"}}`},
+		},
+		{
+			name:    "integer fields",
+			expr:    `call_id == 1 && message_id in [2, 4]`,
+			match:   []string{end, message},
+			noMatch: []string{quick},
+		},
+		{
+			// The header and the descriptors are needed to decode the other records.
+			name:  "header and descriptors",
+			expr:  `false`,
+			match: []string{header, `{"type":"descriptors","descriptors":{}}`},
+		},
+		{
+			name:    "missing field",
+			expr:    `content.value > 5`,
+			noMatch: []string{end},
+		},
+		{
+			name:    "invalid record",
+			expr:    `true`,
+			match:   []string{message},
+			noMatch: []string{`not json`},
+		},
+		{
+			name:    "syntax error",
+			expr:    `type ==`,
+			wantErr: "Syntax error",
+		},
+		{
+			name:    "unknown variable",
+			expr:    `bogus == 1`,
+			wantErr: "undeclared reference to 'bogus'",
+		},
+		{
+			name:    "not a bool",
+			expr:    `method`,
+			wantErr: "filter must evaluate to a bool, not string",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newRecordFilter(tt.expr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range tt.match {
+				if !f.match(line) {
+					t.Errorf("%s does not match %s", tt.expr, line)
+				}
+			}
+			for _, line := range tt.noMatch {
+				if f.match(line) {
+					t.Errorf("%s matches %s", tt.expr, line)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterHandler(t *testing.T) {
+	v := NewGrpcWebViewer("", "")
+	defer v.Shutdown(t.Context()) //nolint:errcheck
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/api/filter?filter=type+%3D%3D+%27end%27", http.StatusNoContent, ""},
+		{"/api/filter", http.StatusNoContent, ""},
+		{"/api/filter?filter=method", http.StatusBadRequest, "Invalid filter: filter must evaluate to a bool, not string\n"},
+		{"/api/filter?filter=bogus+%3D%3D+1", http.StatusBadRequest, "Invalid filter: ERROR: <input>:1:1: undeclared reference to 'bogus'"},
+		// The records are not streamed without a websocket.
+		{"/messages?filter=method", http.StatusBadRequest, "Invalid filter: filter must evaluate to a bool, not string\n"},
+		{"/messages?filter=true", http.StatusUpgradeRequired, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := serve(t, v, http.MethodGet, tt.query)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.HasPrefix(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got body %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultMaxRecords = 100000
+
+	// subscriberBuffer is the number of records that can wait for a slow web client.
+	// A client that falls further behind is disconnected, so that it does not hold back the others.
+	subscriberBuffer = 4096
+)
+
+// hub reads the captured records once and broadcasts them to the web clients.
+//
+// A single ingest goroutine reads the records from the capture file or the ring and keeps the latest ones
+// in a window ordered by message ID. A new client first receives the window and then the new records as they arrive.
+// Each client has its own bounded queue; a client that does not keep up is disconnected.
+// The window is also served by the query API.
+type hub struct {
+	ctx        context.Context
+	ingest     func(ctx context.Context, lines chan<- string, synced func()) // Sends the records and closes the channel when done.
+	maxRecords int
+
+	mu          sync.Mutex
+	running     bool
+	synced      chan struct{} // Closed when the records captured before the ingest started are in the window.
+	pinned      []string      // Capture header and descriptors records, needed to decode the records in the window.
+	window      []hubRecord   // Latest records, in message ID order.
+	subscribers map[*subscriber]struct{}
+}
+
+// hubRecord is a record in the window, with the fields parsed once at ingest.
+type hubRecord struct {
+	summary recordSummary
+	line    string // The record as read from the capture, with the trailing newline.
+}
+
+// subscriber receives the records for a web client.
+type subscriber struct {
+	records chan string // Closed when the client falls behind or the capture cannot be read.
+	after   int64       // Records up to this message ID were already received by the client.
+	slow    bool        // The client was disconnected for falling behind, guarded by hub.mu.
+}
+
+func newHub(ctx context.Context, ingest func(ctx context.Context, lines chan<- string, synced func()), maxRecords int) *hub {
+	if maxRecords <= 0 {
+		maxRecords = defaultMaxRecords
+	}
+	return &hub{
+		ctx:         ctx,
+		ingest:      ingest,
+		maxRecords:  maxRecords,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// subscribe returns the records in the window after the given message ID, and a subscriber receiving the records
+// that arrive after them. The capture header and the descriptors are always returned first.
+// The ingest goroutine is started by the first subscriber, and restarted if it stopped.
+//
+// The records captured so far are read before subscribe returns, so that they are part of the returned records
+// instead of filling the queue of the subscriber.
+func (h *hub) subscribe(ctx context.Context, after int64) ([]string, *subscriber, error) {
+	if err := h.waitSynced(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer h.mu.Unlock()
+
+	window, after := h.after(after)
+	snapshot := make([]string, 0, len(h.pinned)+len(window))
+	snapshot = append(snapshot, h.pinned...)
+	for _, r := range window {
+		snapshot = append(snapshot, r.line)
+	}
+	s := &subscriber{records: make(chan string, subscriberBuffer), after: after}
+	if !h.running {
+		// The capture could not be read.
+		close(s.records)
+		return snapshot, s, nil
+	}
+	h.subscribers[s] = struct{}{}
+	return snapshot, s, nil
+}
+
+// records returns the records in the window, once the records captured so far have been read.
+// The ingest goroutine is started if it is not running.
+// The returned records are not modified by the hub.
+func (h *hub) records(ctx context.Context) ([]hubRecord, error) {
+	if err := h.waitSynced(ctx); err != nil {
+		return nil, err
+	}
+	defer h.mu.Unlock()
+	return h.window, nil
+}
+
+// waitSynced starts the ingest goroutine if it is not running, and waits until it has read the records
+// captured so far, or the ingest has stopped.
+// It returns with the lock held, unless the context is done first.
+func (h *hub) waitSynced(ctx context.Context) error {
+	for {
+		h.mu.Lock()
+		h.start()
+		synced := h.synced
+		h.mu.Unlock()
+
+		select {
+		case <-synced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		h.mu.Lock()
+		// Wait again if the ingest was restarted meanwhile.
+		if h.synced == synced {
+			return nil
+		}
+		h.mu.Unlock()
+	}
+}
+
+// start starts the ingest goroutine if it is not running. It must be called with the lock held.
+func (h *hub) start() {
+	if h.running {
+		return
+	}
+	h.running = true
+	h.pinned, h.window = nil, nil
+	h.synced = make(chan struct{})
+	lines := make(chan string)
+	go h.ingest(h.ctx, lines, func() {
+		// An empty line tells that the ingest has caught up.
+		// It is sent through the channel, so that it arrives after the records.
+		select {
+		case lines <- "":
+		case <-h.ctx.Done():
+		}
+	})
+	go h.run(lines)
+}
+
+// after returns the records in the window after the given message ID, and the ID from which on the new records
+// are sent. If the ID is beyond the last record, the capture has started again from one, and the whole window is returned.
+// Records that have already left the window are not available.
+func (h *hub) after(id int64) ([]hubRecord, int64) {
+	n := len(h.window)
+	if n == 0 {
+		return nil, id
+	}
+	if id > h.window[n-1].summary.MessageId {
+		return h.window, 0
+	}
+	first := sort.Search(n, func(n int) bool { return h.window[n].summary.MessageId > id })
+	return h.window[first:], id
+}
+
+// unsubscribe stops sending records to the subscriber.
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.records)
+	}
+}
+
+// disconnectedSlow returns true if the subscriber was disconnected for falling behind.
+func (h *hub) disconnectedSlow(s *subscriber) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return s.slow
+}
+
+// run adds the records read by the ingest goroutine to the window and broadcasts them.
+// When the records can no longer be read, the subscribers are disconnected.
+func (h *hub) run(lines <-chan string) {
+	for line := range lines {
+		if line == "" {
+			h.markSynced()
+			continue
+		}
+		h.add(line)
+	}
+
+	h.markSynced()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = false
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		close(s.records)
+	}
+}
+
+// markSynced wakes up the requests waiting for the records captured so far.
+func (h *hub) markSynced() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.synced:
+	default:
+		close(h.synced)
+	}
+}
+
+func (h *hub) add(line string) {
+	fields := parseSummary(line)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case fields.Type == recordCapture:
+		// The header of a capture file holds the descriptors of all the earlier files.
+		h.pinned = []string{line}
+	case fields.Type == recordDescriptors:
+		h.pinned = append(h.pinned, line)
+	case fields.MessageId > 0:
+		// Message IDs start again from one when the file is overwritten by a new process.
+		if n := len(h.window); n > 0 && fields.MessageId <= h.window[n-1].summary.MessageId {
+			h.window = nil
+			for s := range h.subscribers {
+				s.after = 0
+			}
+		}
+		h.window = append(h.window, hubRecord{summary: fields, line: line})
+		if len(h.window) > h.maxRecords {
+			// The memory of the dropped records is released when append moves the window to a new array.
+			h.window = h.window[len(h.window)-h.maxRecords:]
+		}
+	}
+
+	for s := range h.subscribers {
+		if fields.MessageId > 0 && fields.MessageId <= s.after {
+			continue
+		}
+		select {
+		case s.records <- line:
+		default:
+			s.slow = true
+			delete(h.subscribers, s)
+			close(s.records)
+		}
+	}
+}
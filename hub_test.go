@@ -0,0 +1,263 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ingestLines returns an ingest function sending the given records and then waiting for new ones.
+func ingestLines(records []string, more <-chan string) func(ctx context.Context, lines chan<- string, synced func()) {
+	return func(ctx context.Context, lines chan<- string, synced func()) {
+		defer close(lines)
+		for _, r := range records {
+			select {
+			case lines <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+		synced()
+		for {
+			select {
+			case r, ok := <-more:
+				if !ok {
+					return
+				}
+				select {
+				case lines <- r:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func testRecords(first, last int) []string {
+	var records []string
+	for id := first; id <= last; id++ {
+		records = append(records, fmt.Sprintf(`{"message_id":%d,"type":"message","call_id":1}`+"\n", id))
+	}
+	return records
+}
+
+func TestHubSubscribeLargeCapture(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The existing records are far more than the queue of a subscriber can hold.
+	records := append([]string{`{"type":"capture"}` + "\n"}, testRecords(1, 10*subscriberBuffer)...)
+	more := make(chan string)
+	h := newHub(ctx, ingestLines(records, more), 0)
+
+	snapshot, sub, err := h.subscribe(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.unsubscribe(sub)
+	if len(snapshot) != len(records) {
+		t.Fatalf("got %d records in the snapshot, want %d", len(snapshot), len(records))
+	}
+
+	more <- testRecords(10*subscriberBuffer+1, 10*subscriberBuffer+1)[0]
+	select {
+	case r, ok := <-sub.records:
+		if !ok {
+			t.Fatalf("subscriber was disconnected, slow: %v", h.disconnectedSlow(sub))
+		}
+		if want := testRecords(10*subscriberBuffer+1, 10*subscriberBuffer+1)[0]; r != want {
+			t.Errorf("got %q, want %q", r, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record received")
+	}
+}
+
+func TestHubSubscribeAfter(t *testing.T) {
+	tests := []struct {
+		after int64
+		want  int // Records in the snapshot, including the capture header.
+	}{
+		{0, 11},
+		{7, 4},
+		{10, 1},
+		{99, 11}, // The capture has started again.
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.after), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			records := append([]string{`{"type":"capture"}` + "\n"}, testRecords(1, 10)...)
+			h := newHub(ctx, ingestLines(records, nil), 0)
+
+			snapshot, sub, err := h.subscribe(ctx, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.unsubscribe(sub)
+			if len(snapshot) != tt.want {
+				t.Errorf("got %d records, want %d", len(snapshot), tt.want)
+			}
+		})
+	}
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	more := make(chan string)
+	h := newHub(ctx, ingestLines(nil, more), 0)
+
+	_, sub, err := h.subscribe(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.unsubscribe(sub)
+	// The ingest can be one record ahead of the hub, and the hub one record ahead of adding it,
+	// so the queue has overflowed once two more records have been taken.
+	for _, r := range testRecords(1, subscriberBuffer+3) {
+		more <- r
+	}
+
+	// The queued records are still received before the channel is closed.
+	received := 0
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-sub.records:
+			if !ok {
+				if received != subscriberBuffer {
+					t.Errorf("got %d records, want %d", received, subscriberBuffer)
+				}
+				if !h.disconnectedSlow(sub) {
+					t.Error("subscriber was not disconnected as slow")
+				}
+				return
+			}
+			received++
+		case <-timeout:
+			t.Fatalf("subscriber was not disconnected after %d records", received)
+		}
+	}
+}
+
+// receiveRecords returns the next n records of the subscriber.
+func receiveRecords(t *testing.T, sub *subscriber, n int) []string {
+	t.Helper()
+	var records []string
+	for len(records) < n {
+		select {
+		case r, ok := <-sub.records:
+			if !ok {
+				t.Fatalf("subscriber was disconnected after %q", records)
+			}
+			records = append(records, r)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q, want %d records", records, n)
+		}
+	}
+	return records
+}
+
+func TestHubResume(t *testing.T) {
+	header := `{"type":"capture"}` + "\n"
+	descriptors := `{"type":"descriptors"}` + "\n"
+
+	tests := []struct {
+		name  string
+		after int64
+		want  []string
+	}{
+		{"all", 0, append([]string{header, descriptors}, testRecords(6, 10)...)},
+		{"middle of the window", 7, append([]string{header, descriptors}, testRecords(8, 10)...)},
+		{"last record", 10, []string{header, descriptors}},
+		// The records between the last one received and the window are no longer available.
+		{"before the window", 3, append([]string{header, descriptors}, testRecords(6, 10)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// The window keeps the last five records, the descriptors are kept even if the records before them are not.
+			records := append([]string{header}, testRecords(1, 5)...)
+			records = append(append(records, descriptors), testRecords(6, 10)...)
+			more := make(chan string)
+			h := newHub(ctx, ingestLines(records, more), 5)
+
+			snapshot, sub, err := h.subscribe(ctx, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.unsubscribe(sub)
+			if !reflect.DeepEqual(snapshot, tt.want) {
+				t.Errorf("got snapshot %q, want %q", snapshot, tt.want)
+			}
+
+			// The new records follow the snapshot without gaps.
+			more <- testRecords(11, 11)[0]
+			if got, want := receiveRecords(t, sub, 1), testRecords(11, 11); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHubResumeAfterReset(t *testing.T) {
+	header := `{"type":"capture","source":"restarted"}` + "\n"
+	restarted := append([]string{header}, testRecords(1, 2)...)
+
+	tests := []struct {
+		name  string
+		after int64
+		want  []string
+	}{
+		// A client that received records of the earlier capture resumes after an ID beyond the new window.
+		{"earlier capture", 10, restarted},
+		{"new capture", 1, []string{header, testRecords(2, 2)[0]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			records := append([]string{`{"type":"capture"}` + "\n"}, testRecords(1, 10)...)
+			more := make(chan string)
+			h := newHub(ctx, ingestLines(records, more), 0)
+
+			_, sub, err := h.subscribe(ctx, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.unsubscribe(sub)
+
+			// The capture file is recreated by a new process: its message IDs start again from one,
+			// and the subscriber receives them although it has already received records with the same IDs.
+			for _, r := range restarted {
+				more <- r
+			}
+			if got := receiveRecords(t, sub, len(restarted)); !reflect.DeepEqual(got, restarted) {
+				t.Errorf("got %q, want %q", got, restarted)
+			}
+
+			snapshot, resumed, err := h.subscribe(ctx, tt.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.unsubscribe(resumed)
+			if !reflect.DeepEqual(snapshot, tt.want) {
+				t.Errorf("got snapshot %q, want %q", snapshot, tt.want)
+			}
+
+			more <- testRecords(3, 3)[0]
+			for _, s := range []*subscriber{sub, resumed} {
+				if got, want := receiveRecords(t, s, 1), testRecords(3, 3); !reflect.DeepEqual(got, want) {
+					t.Errorf("got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -4,44 +4,157 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"os"
+	"reflect"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
-// GrpcJsonInterceptor intercepts gRPC calls and logs the request and response messages as JSON to a file.
+// GrpcJsonInterceptor intercepts gRPC calls and logs the request and response messages as JSON to a Sink.
 // It also serves a web viewer for the logged messages.
 type GrpcJsonInterceptor struct {
-	output    *os.File
-	messageId int64 // Unique identifier for each message.
-	streamId  int64 // Unique identifier for each stream.
+	writer    *captureWriter
+	capture   *sharedCapture // Capture written by the interceptor, possibly shared with other interceptors.
+	source    string         // Label of the interceptor in the records.
 	marshaler protojson.MarshalOptions
-	viewer    *GrpcWebViewer
+
+	metadataFilter metadataFilter
+	redactor       *redactor
+	truncator      *truncator
+	rules          atomic.Pointer[ruleSet]
+	rawPayload     bool
+	typeCollector  *typeCollector
+	traceExtractor TraceExtractor
+
+	// Runtime control of the capture.
+	enabled    atomic.Bool
+	fileSink   *FileSink // The file configured with WithFilename, nil if none.
+	stopSignal func()    // Stops watching the toggle signal.
 }
 
 type grpcJsonInterceptorOptions struct {
 	Filename string
 	Addr     string
+	Listener net.Listener
+	Sinks    []Sink
+	Rotation Rotation
+	Source   string
+
+	MemoryBuffer *RingSink
+
+	QueueSize      int
+	OverflowPolicy OverflowPolicy
+
+	MetadataAllowList []string
+	MetadataDenyList  []string
+
+	RedactFields   map[string]RedactionMode
+	RedactMetadata map[string]RedactionMode
+	RedactionKey   []byte
+
+	Rules []CaptureRule
+
+	SizeLimits SizeLimits
+
+	RawPayload     bool
+	MarshalOptions protojson.MarshalOptions
+
+	TraceExtractor TraceExtractor
+	ViewerOptions  []func(*grpcWebViewerOptions)
+
+	Disabled     bool
+	ToggleSignal os.Signal
 }
 
 type capturedMessage struct {
-	MessageId  int64           `json:"message_id"`
-	StreamId   *int64          `json:"stream_id,omitempty"`
-	Direction  direction       `json:"direction"`
-	Time       string          `json:"time"`
-	FullMethod string          `json:"method"`
-	Message    string          `json:"message"`
-	PeerAddr   string          `json:"peer_address"`
-	Error      string          `json:"error,omitempty"`
-	Content    json.RawMessage `json:"content"`
+	MessageId  int64               `json:"message_id"`
+	CallId     int64               `json:"call_id"`
+	StreamId   *int64              `json:"stream_id,omitempty"`
+	TraceId    string              `json:"trace_id,omitempty"`
+	SpanId     string              `json:"span_id,omitempty"`
+	Type       recordType          `json:"type"`
+	Direction  direction           `json:"direction,omitempty"`
+	Side       side                `json:"side"`
+	Source     string              `json:"source,omitempty"` // Label of the interceptor that captured the record.
+	Time       string              `json:"time"`
+	FullMethod string              `json:"method"`
+	Message    string              `json:"message,omitempty"`
+	PeerAddr   string              `json:"peer_address"`
+	Error      string              `json:"error,omitempty"`
+	Status     *capturedStatus     `json:"status,omitempty"`
+	Metadata   map[string][]string `json:"metadata,omitempty"`
+	Content    json.RawMessage     `json:"content,omitempty"`
+	Raw        []byte              `json:"raw,omitempty"`   // Serialized payload, encoded as base64.
+	Codec      string              `json:"codec,omitempty"` // Codec that serialized a payload other than protobuf.
+
+	MarshalError string `json:"marshal_error,omitempty"` // Why the payload could not be converted to JSON.
+
+	// Size of the payload and the limits applied to it.
+	Size           *int             `json:"size,omitempty"`            // Serialized size of the payload as sent, before redaction and truncation.
+	ContentHash    string           `json:"content_hash,omitempty"`    // SHA-256 of the deterministically serialized payload, after redaction.
+	Truncated      []truncatedField `json:"truncated,omitempty"`       // Fields shortened by the size limits.
+	ContentOmitted bool             `json:"content_omitted,omitempty"` // The content exceeded the maximum record size.
+
+	// Call lifecycle.
+	Deadline         string  `json:"deadline,omitempty"`
+	TimeoutMs        float64 `json:"timeout_ms,omitempty"`
+	DurationMs       float64 `json:"duration_ms,omitempty"`
+	MessagesSent     *int64  `json:"messages_sent,omitempty"`
+	MessagesReceived *int64  `json:"messages_received,omitempty"`
+	Cause            string  `json:"cause,omitempty"`
+	ElapsedMs        float64 `json:"elapsed_ms,omitempty"` // Time from the request to the response of a unary call.
+
+	// Transport details, captured only by the stats handler.
+	PayloadLength    int    `json:"payload_length,omitempty"`    // Size of the uncompressed payload.
+	CompressedLength int    `json:"compressed_length,omitempty"` // Size of the compressed payload.
+	WireLength       int    `json:"wire_length,omitempty"`       // Size of the payload with gRPC framing, or of the headers.
+	Compression      string `json:"compression,omitempty"`       // Compression algorithm of the call.
+	Attempt          int    `json:"attempt,omitempty"`           // Attempt number of a client call.
+	TransparentRetry bool   `json:"transparent_retry,omitempty"` // The attempt is a transparent retry of a previous attempt.
+
+	// Message types used by the record, whose descriptors are written to the capture.
+	messageTypes []protoreflect.MessageDescriptor
 }
 
+// types returns the message types used by the record, including the error details of its status.
+func (m *capturedMessage) types() []protoreflect.MessageDescriptor {
+	if m.Status == nil {
+		return m.messageTypes
+	}
+	return append(m.messageTypes[:len(m.messageTypes):len(m.messageTypes)], m.Status.types...)
+}
+
+// recordType tells what a captured record describes.
+type recordType string
+
+const (
+	recordMessage recordType = "message" // A request or response message.
+	recordHeader  recordType = "header"  // Request or response headers.
+	recordTrailer recordType = "trailer" // Response trailers.
+
+	recordStart     recordType = "start"      // The call started.
+	recordHalfClose recordType = "half_close" // The client closed its sending side of the stream.
+	recordEnd       recordType = "end"        // The call ended with a status.
+	recordCancel    recordType = "cancel"     // The context of the call was cancelled before the call ended.
+
+	recordCapture     recordType = "capture"     // Header at the start of each capture file.
+	recordDescriptors recordType = "descriptors" // Descriptors of message types seen for the first time.
+
+	recordHeartbeat recordType = "heartbeat" // Sent periodically to the web clients, never written to the capture.
+)
+
+// direction tells whether the message was sent or received by this process.
 type direction string
 
 const (
@@ -49,56 +162,158 @@ const (
 	directionReceive direction = "recv"
 )
 
+// side tells whether this process was the client or the server of the RPC.
+type side string
+
+const (
+	sideClient side = "client"
+	sideServer side = "server"
+)
+
+// call holds the state shared by all messages of a single RPC.
+type call struct {
+	ctx      context.Context // Context of a server stream, with the wrapped transport stream.
+	id       int64
+	method   string
+	side     side
+	streamId *int64    // Same as id for streaming calls, nil for unary calls.
+	codec    *rawCodec // Codec of the call, for payloads that are not protobuf messages.
+	attempt  int       // Attempt number of a client call captured by the stats handler, zero otherwise.
+	traceId  string    // Trace the call belongs to, if known.
+	spanId   string
+
+	mu              sync.Mutex
+	header          metadata.MD // Headers set by a server handler but not sent yet.
+	headerCaptured  bool
+	trailer         metadata.MD // Trailers set by a server handler.
+	trailerCaptured bool
+	ended           bool
+	rules           *ruleSet // Rules in effect when the call started.
+
+	peerAddr        atomic.Pointer[string] // Address of the remote peer, which may become known only after the call has started.
+	start           time.Time
+	sent            atomic.Int64 // Number of messages sent.
+	received        atomic.Int64 // Number of messages received.
+	stopCancelWatch func() bool
+
+	// State of the capture rules.
+	matchPeer string             // Peer address matched against the rules.
+	sample    float64            // Random number in [0, 1) deciding if the call is sampled.
+	limited   int                // Number of messages matched by rules with First or Last limits.
+	tailSize  int                // Number of last messages to keep.
+	tail      []*capturedMessage // Last messages, written when the call ends.
+}
+
 // NewGrpcJsonInterceptor creates a new GrpcJsonInterceptor instance.
 //
 // It can be configured using the environment variables:
 // - GRPC_JSON_SNIFFER_FILE: enables JSON logging to a specified file.
 // - GRPC_JSON_SNIFFER_ADDR: enables serving the web viewer at a specified address.
+// - GRPC_JSON_SNIFFER_RULES: selects which calls and messages are captured, see ParseCaptureRules.
+// - GRPC_JSON_SNIFFER_ENABLED: set to false to start with the capture disabled, see Enable.
+// - GRPC_JSON_SNIFFER_BUFFER: keeps the given number of last records in memory, see WithMemoryBuffer.
 //
 // Alternatively, it can be configured through options:
 // - WithFilename: enables JSON logging to a specified file.
 // - WithAddr: enables serving the web viewer at a specified address.
+// - WithListener: serves the web viewer on a given listener.
+// - WithSink: enables JSON logging to a custom Sink.
+// - WithMemoryBuffer: keeps the last records in memory, without a file.
+// - WithSource: labels the records of the interceptor.
+// - WithRotation: rotates the file by size or age.
+// - WithQueueSize: sets the number of messages buffered for the background writer.
+// - WithOverflowPolicy: decides what happens to messages when the buffer is full.
+// - WithMetadataAllowList, WithMetadataDenyList: select which headers and trailers are captured.
+// - WithRedactFields, WithRedactMetadata, WithRedactionKey: hide sensitive values from the capture.
+// - WithCaptureRules: selects which calls and messages are captured.
+// - WithSizeLimits: truncates large fields and leaves out the content of large messages.
+// - WithRawPayload: captures the serialized payload next to the JSON content.
+// - WithMarshalOptions: sets how the messages are converted to JSON.
+// - WithTraceExtractor: records the trace of each call from the span in its context.
+// - WithViewerOptions: configures the web viewer, for example to link the traces to a tracing UI.
+// - WithEnabled, WithToggleSignal: start with the capture disabled and toggle it at runtime.
 //
 // Note: If option functions (WithFilename or WithAddr) are provided, they take precedence
 // and override the corresponding environment variables.
 func NewGrpcJsonInterceptor(options ...func(*grpcJsonInterceptorOptions)) (*GrpcJsonInterceptor, error) {
+	rules, err := ParseCaptureRules(os.Getenv("GRPC_JSON_SNIFFER_RULES"))
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := true
+	if env := os.Getenv("GRPC_JSON_SNIFFER_ENABLED"); env != "" {
+		enabled, err = strconv.ParseBool(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GRPC_JSON_SNIFFER_ENABLED: %w", err)
+		}
+	}
+
+	var memoryBuffer *RingSink
+	if env := os.Getenv("GRPC_JSON_SNIFFER_BUFFER"); env != "" {
+		records, err := strconv.Atoi(env)
+		if err != nil || records <= 0 {
+			return nil, fmt.Errorf("invalid GRPC_JSON_SNIFFER_BUFFER: %q", env)
+		}
+		memoryBuffer = NewRingSink(records, 0)
+	}
+
 	opts := grpcJsonInterceptorOptions{
-		Filename: os.Getenv("GRPC_JSON_SNIFFER_FILE"),
-		Addr:     os.Getenv("GRPC_JSON_SNIFFER_ADDR"),
+		Filename:     os.Getenv("GRPC_JSON_SNIFFER_FILE"),
+		Addr:         os.Getenv("GRPC_JSON_SNIFFER_ADDR"),
+		MemoryBuffer: memoryBuffer,
+		Rules:        rules,
+		Disabled:     !enabled,
+		MarshalOptions: protojson.MarshalOptions{
+			EmitUnpopulated: true,
+		},
 	}
 
 	for _, option := range options {
 		option(&opts)
 	}
-
-	// If no filename is provided, return an interceptor that does nothing.
-	if opts.Filename == "" {
-		return &GrpcJsonInterceptor{}, nil
+	if opts.MarshalOptions.Multiline || opts.MarshalOptions.Indent != "" {
+		return nil, fmt.Errorf("marshal options Multiline and Indent are not supported, each record is written on a single line")
 	}
 
-	f, err := os.OpenFile(opts.Filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	// Interceptors writing to the same file share the capture.
+	capture, err := acquireCapture(&opts)
 	if err != nil {
 		return nil, err
 	}
 
-	var viewer *GrpcWebViewer
-	if opts.Addr != "" {
-		viewer = NewGrpcWebViewer(opts.Addr, opts.Filename)
-		go viewer.Serve()
+	// If no sink is configured, return an interceptor that does nothing.
+	if capture == nil {
+		return &GrpcJsonInterceptor{}, nil
 	}
 
-	return &GrpcJsonInterceptor{
-		output: f,
-		marshaler: protojson.MarshalOptions{
-			EmitUnpopulated: true,
-		},
-		viewer: viewer,
-	}, nil
+	i := &GrpcJsonInterceptor{
+		writer:         capture.writer,
+		capture:        capture,
+		source:         opts.Source,
+		metadataFilter: newMetadataFilter(opts.MetadataAllowList, opts.MetadataDenyList),
+		redactor:       newRedactor(opts.RedactFields, opts.RedactMetadata, opts.RedactionKey, opts.MarshalOptions.Resolver),
+		truncator:      newTruncator(opts.SizeLimits),
+		rawPayload:     opts.RawPayload,
+		traceExtractor: opts.TraceExtractor,
+		marshaler:      opts.MarshalOptions,
+		typeCollector:  newTypeCollector(opts.MarshalOptions.Resolver),
+		fileSink:       capture.fileSink,
+	}
+	i.rules.Store(newRuleSet(opts.Rules))
+	i.enabled.Store(!opts.Disabled)
+	capture.join(i)
+
+	if opts.ToggleSignal != nil {
+		i.stopSignal = i.watchToggleSignal(opts.ToggleSignal)
+	}
+	return i, nil
 }
 
 // WithFilename sets the filename for the GrpcJsonInterceptor.
 //
-// If an empty string is provided, logging is disabled and the interceptor becomes a no-op.
+// If an empty string is provided, logging to a file is disabled.
+// Unless a Sink is configured with WithSink, the interceptor becomes a no-op.
 //
 // Example:
 //
@@ -113,6 +328,7 @@ func WithFilename(filename string) func(*grpcJsonInterceptorOptions) {
 //
 // If an empty string is provided, the web viewer is disabled.
 // Logging to the file (if a filename is configured) will continue to work, but no web interface will be available.
+// The web viewer requires a filename or a memory buffer to be configured, since it reads the messages back from them.
 //
 // Example:
 //
@@ -123,137 +339,766 @@ func WithAddr(addr string) func(*grpcJsonInterceptorOptions) {
 	}
 }
 
-func (i *GrpcJsonInterceptor) writeMessage(ctx context.Context, direction direction, fullMethod string, payload any, handlerError error, streamId *int64) {
-	msg, ok := payload.(proto.Message)
-	if !ok {
-		return
+// WithListener serves the web viewer on the given listener instead of the address set with WithAddr.
+//
+// It allows choosing the network and address freely, for example a random port in tests.
+// The listener is closed when the interceptor is closed.
+// The web viewer requires a filename or a memory buffer to be configured, since it reads the messages back from them,
+// NewGrpcJsonInterceptor returns an error if only other sinks are configured.
+// The listener is closed right away if it is not used: when no sink is configured and the interceptor does nothing,
+// or when the capture file is shared with an interceptor that already serves the web viewer.
+//
+// Example:
+//
+//	listener, err := net.Listen("tcp", "localhost:0")
+//	interceptor, err := NewGrpcJsonInterceptor(WithFilename("grpc_messages.json"), WithListener(listener))
+func WithListener(listener net.Listener) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.Listener = listener
 	}
+}
 
-	handlerErrorMessage := ""
-	if handlerError != nil {
-		handlerErrorMessage = fmt.Sprintf("%v", handlerError)
+// WithSink adds a Sink that receives the captured messages.
+//
+// The option can be given multiple times to write to several sinks.
+// If a filename is configured as well, the messages are written both to the file and to the sinks.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithSink(NewWriterSink(os.Stdout)))
+func WithSink(sink Sink) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.Sinks = append(o.Sinks, sink)
 	}
+}
 
-	b, err := i.marshaler.Marshal(msg)
-	if err != nil {
-		return
+// WithMemoryBuffer keeps the last records in memory, discarding the oldest ones, see NewRingSink.
+//
+// It allows capturing without writing any file, for example in containers with a read-only filesystem or in tests.
+// If no file is configured, the web viewer serves the records from memory, and they can be saved with
+// the download link of the web viewer.
+// For access to the records in tests, create the RingSink and give it with WithSink instead.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithMemoryBuffer(10000, 64*1024*1024), WithAddr("localhost:8080"))
+func WithMemoryBuffer(maxRecords, maxBytes int) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.MemoryBuffer = NewRingSink(maxRecords, maxBytes)
 	}
-	var peerAddr string
-	p, ok := peer.FromContext(ctx)
-	if ok {
-		if tcpAddr, ok := p.Addr.(*net.TCPAddr); ok {
-			peerAddr = tcpAddr.String()
+}
+
+// WithSource sets the label written in the "source" field of the records of the interceptor.
+//
+// Interceptors configured with the same file share the capture: their records are written to the file
+// with unique message and call IDs, and served by a single web viewer.
+// The label tells apart the records of each interceptor, for example the server and the clients of a process.
+// The sinks, rotation and writer of a shared capture are configured by the first interceptor created,
+// and the web viewer by the first interceptor with an address.
+//
+// Example:
+//
+//	server, err := NewGrpcJsonInterceptor(WithFilename("grpc_messages.json"), WithAddr("localhost:8080"), WithSource("server"))
+//	billing, err := NewGrpcJsonInterceptor(WithFilename("grpc_messages.json"), WithSource("billing-client"))
+func WithSource(label string) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.Source = label
+	}
+}
+
+// WithRotation enables rotation of the file configured with WithFilename or GRPC_JSON_SNIFFER_FILE.
+//
+// The web viewer follows the capture across rotations.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithRotation(Rotation{
+//		MaxSize:  100 * 1024 * 1024,
+//		MaxFiles: 10,
+//		Compress: true,
+//	}))
+func WithRotation(rotation Rotation) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.Rotation = rotation
+	}
+}
+
+// WithQueueSize sets the number of captured messages that can wait for the background writer.
+//
+// Messages are written to the sinks by a background goroutine, so that the gRPC calls are not blocked by I/O.
+// If zero or negative, a default size of 1024 messages is used.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithQueueSize(10000))
+func WithQueueSize(size int) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.QueueSize = size
+	}
+}
+
+// WithOverflowPolicy sets what happens to captured messages when the writer queue is full.
+//
+// The default is OverflowBlock, which never loses messages but slows down the gRPC calls while the queue is full.
+// OverflowDropNewest and OverflowDropOldest keep the gRPC calls running at full speed and count the dropped messages
+// in the statistics returned by Stats.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithOverflowPolicy(OverflowDropOldest))
+func WithOverflowPolicy(policy OverflowPolicy) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.OverflowPolicy = policy
+	}
+}
+
+// WithMetadataAllowList limits the captured headers and trailers to the given keys.
+//
+// Keys are matched case-insensitively.
+// If not set, all keys are captured, except the ones in the deny list.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithMetadataAllowList("authorization", "x-request-id"))
+func WithMetadataAllowList(keys ...string) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.MetadataAllowList = append(o.MetadataAllowList, keys...)
+	}
+}
+
+// WithMetadataDenyList excludes the given keys from the captured headers and trailers.
+//
+// Keys are matched case-insensitively.
+// The deny list takes precedence over the allow list.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithMetadataDenyList("user-agent"))
+func WithMetadataDenyList(keys ...string) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.MetadataDenyList = append(o.MetadataDenyList, keys...)
+	}
+}
+
+// WithRedactFields hides the values of the given message fields in the capture.
+//
+// Fields are given by their fully qualified name, for example "demo.HelloRequest.name".
+// Fields marked with the debug_redact option in the proto definition are masked even without this option.
+// Only string and bytes values can be masked or hashed, values of other types are removed.
+// Messages packed in google.protobuf.Any fields and in the error details of a status are redacted too,
+// if their type can be resolved, see WithMarshalOptions.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithRedactFields(RedactHash, "demo.LoginRequest.password"))
+func WithRedactFields(mode RedactionMode, fields ...string) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		if o.RedactFields == nil {
+			o.RedactFields = make(map[string]RedactionMode)
+		}
+		for _, field := range fields {
+			o.RedactFields[field] = mode
+		}
+	}
+}
+
+// WithRedactMetadata hides the values of the given header and trailer keys in the capture.
+//
+// Keys are matched case-insensitively.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithRedactMetadata(RedactMask, "authorization", "cookie"))
+func WithRedactMetadata(mode RedactionMode, keys ...string) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		if o.RedactMetadata == nil {
+			o.RedactMetadata = make(map[string]RedactionMode)
+		}
+		for _, key := range keys {
+			o.RedactMetadata[key] = mode
+		}
+	}
+}
+
+// WithRedactionKey sets the key of the HMAC-SHA256 hash used by RedactHash.
+//
+// Setting the same key in several processes allows correlating the hashed values across their captures.
+// If not set, a random key is generated, and the hashes can be correlated only within a single process.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithRedactionKey([]byte(os.Getenv("SNIFFER_REDACTION_KEY"))))
+func WithRedactionKey(key []byte) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.RedactionKey = key
+	}
+}
+
+// WithCaptureRules sets the rules that select which calls and messages are captured.
+//
+// Rules are evaluated in order and the first matching rule decides.
+// Records that do not match any rule are captured.
+// Calls excluded by a rule are not intercepted at all, so they cost almost nothing.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithCaptureRules(
+//		CaptureRule{Exclude: true, Method: "/grpc.health.v1.Health/*"},
+//		CaptureRule{Method: "/demo.Demo/*", SampleRate: 0.1},
+//	))
+func WithCaptureRules(rules ...CaptureRule) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.Rules = rules
+	}
+}
+
+// WithSizeLimits limits the size of the captured messages.
+//
+// String and bytes fields longer than MaxFieldSize are cut, and repeated fields and maps with more
+// than MaxRepeated elements are shortened, listing the shortened fields in the "truncated" field of the record.
+// If the content of a message is still larger than MaxRecordSize, it is left out of the record.
+// The "size" and "content_hash" fields of the record always describe the complete message,
+// so that identical payloads can be recognized even when truncated.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithSizeLimits(SizeLimits{
+//		MaxRecordSize: 1024 * 1024,
+//		MaxFieldSize:  4096,
+//		MaxRepeated:   100,
+//	}))
+func WithSizeLimits(limits SizeLimits) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.SizeLimits = limits
+	}
+}
+
+// WithRawPayload enables capturing the serialized payload of each message, encoded as base64 in the "raw" field.
+//
+// The raw bytes hold everything that JSON cannot represent, such as unknown fields,
+// allowing byte-exact replay of the messages.
+// Payloads that are not protobuf messages, such as those of custom codecs, are captured only in this mode.
+// Redacted fields are redacted also in the raw bytes.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithRawPayload(true))
+func WithRawPayload(enabled bool) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.RawPayload = enabled
+	}
+}
+
+// WithMarshalOptions sets the options for converting the messages to JSON.
+//
+// The default is protojson.MarshalOptions{EmitUnpopulated: true}.
+// A Resolver can be given to expand google.protobuf.Any fields whose types are not linked into the binary,
+// for example one created with dynamicpb.NewTypes from the descriptors of the APIs.
+// Each record is written on a single line, so Multiline and Indent are not supported,
+// and NewGrpcJsonInterceptor returns an error if they are set.
+// If a message cannot be converted, it is captured as serialized bytes in the "raw" field,
+// with the reason in the "marshal_error" field.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithMarshalOptions(protojson.MarshalOptions{
+//		UseProtoNames:   true,
+//		UseEnumNumbers:  true,
+//		EmitUnpopulated: true,
+//		Resolver:        types,
+//	}))
+func WithMarshalOptions(options protojson.MarshalOptions) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.MarshalOptions = options
+	}
+}
+
+// WithTraceExtractor sets the function that returns the trace and span IDs of the span in the context of a call.
+//
+// The IDs are recorded on every record of the call as trace_id and span_id.
+// Without an extractor, or if the context has no span, the IDs are taken from the W3C traceparent header of the call.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithTraceExtractor(func(ctx context.Context) (string, string, bool) {
+//		sc := trace.SpanContextFromContext(ctx)
+//		return sc.TraceID().String(), sc.SpanID().String(), sc.IsValid()
+//	}))
+func WithTraceExtractor(extractor TraceExtractor) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.TraceExtractor = extractor
+	}
+}
+
+// WithViewerOptions sets the options of the web viewer served by the interceptor.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithViewerOptions(WithTraceURL("http://localhost:16686/trace/{trace_id}")))
+func WithViewerOptions(options ...func(*grpcWebViewerOptions)) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.ViewerOptions = append(o.ViewerOptions, options...)
+	}
+}
+
+// WithEnabled sets whether the capture is enabled when the interceptor is created.
+//
+// A disabled interceptor passes the calls through at almost no cost.
+// The capture can be enabled later with Enable, the control endpoint of the web viewer, or the toggle signal.
+// The sinks are created even when disabled, so that the capture can start immediately when enabled.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithFilename("grpc_messages.json"), WithEnabled(false))
+func WithEnabled(enabled bool) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.Disabled = !enabled
+	}
+}
+
+// WithToggleSignal enables and disables the capture each time the process receives the given signal.
+//
+// Example:
+//
+//	interceptor, err := NewGrpcJsonInterceptor(WithEnabled(false), WithToggleSignal(syscall.SIGUSR1))
+func WithToggleSignal(sig os.Signal) func(*grpcJsonInterceptorOptions) {
+	return func(o *grpcJsonInterceptorOptions) {
+		o.ToggleSignal = sig
+	}
+}
+
+// Flush waits until the messages captured before the call have been written to the sinks.
+func (i *GrpcJsonInterceptor) Flush() error {
+	if i.writer == nil {
+		return nil
+	}
+	return i.writer.flush()
+}
+
+// Close stops the web viewer, writes the remaining captured messages and closes the sinks.
+// If the capture is shared with other interceptors, it is closed when the last of them is closed.
+//
+// Messages captured after Close are discarded, so the interceptors can remain installed.
+// If the context expires before all messages are written, Close returns the context error,
+// and the remaining messages are written and the sinks closed in the background.
+func (i *GrpcJsonInterceptor) Close(ctx context.Context) error {
+	if i.writer == nil {
+		return nil
+	}
+	if i.stopSignal != nil {
+		i.stopSignal()
+	}
+	// Other interceptors may keep writing to a shared capture, new calls of this one are no longer captured.
+	i.Disable()
+	return i.capture.leave(ctx, i)
+}
+
+// Stats returns the counters of written and dropped messages.
+func (i *GrpcJsonInterceptor) Stats() CaptureStats {
+	if i.writer == nil {
+		return CaptureStats{}
+	}
+	return i.writer.stats()
+}
+
+// newCall creates the state for a new RPC.
+// Every call is assigned a call ID. Streaming calls use the call ID also as their stream ID.
+func (i *GrpcJsonInterceptor) newCall(ctx context.Context, method string, side side, streaming bool, matchPeer string) *call {
+	c := &call{
+		ctx:       ctx,
+		id:        i.capture.callId.Add(1),
+		method:    method,
+		side:      side,
+		rules:     i.rules.Load(),
+		matchPeer: matchPeer,
+		sample:    rand.Float64(),
+	}
+	if streaming {
+		c.streamId = &c.id
+	}
+	c.setPeer(peerAddress(ctx))
+	c.traceId, c.spanId = i.traceContext(ctx, requestMetadata(ctx, side))
+	return c
+}
+
+// writeMessage captures a message of the call.
+//
+// The payload can be nil if the RPC failed before a message was available,
+// in which case a record is written only if there is an error to report.
+func (i *GrpcJsonInterceptor) writeMessage(c *call, direction direction, payload any, handlerError error) {
+	if m, decision := i.newMessageRecord(c, direction, payload, handlerError); m != nil {
+		i.writeMessageRecord(c, m, decision)
+	}
+}
+
+// newMessageRecord creates the record of a message and decides, according to the capture rules, what to do with it.
+// It returns nil if the message is not captured.
+func (i *GrpcJsonInterceptor) newMessageRecord(c *call, direction direction, payload any, handlerError error) (*capturedMessage, captureDecision) {
+	if handlerError == nil && payload != nil {
+		if direction == directionSend {
+			c.sent.Add(1)
 		} else {
-			peerAddr = p.Addr.String()
+			c.received.Add(1)
 		}
-	} else {
-		peerAddr = "unknown"
 	}
 
-	messageId := atomic.AddInt64(&i.messageId, 1)
+	// Evaluate the rules before marshaling, so that dropped messages cost almost nothing.
+	c.mu.Lock()
+	decision := c.rules.decide(c, true, direction)
+	c.mu.Unlock()
+	if decision == captureDrop {
+		return nil, decision
+	}
 
-	m := capturedMessage{
-		MessageId:  messageId,
-		Direction:  direction,
-		Time:       time.Now().Format(time.RFC3339Nano),
-		FullMethod: fullMethod,
-		Message:    string(msg.ProtoReflect().Descriptor().FullName()),
-		StreamId:   streamId,
-		PeerAddr:   peerAddr,
-		Error:      handlerErrorMessage,
-		Content:    json.RawMessage(b),
+	var messageName string
+	var messageTypes []protoreflect.MessageDescriptor
+	var content json.RawMessage
+	var raw []byte
+	var marshalError string
+	var size *int
+	var hash string
+	var truncated []truncatedField
+	switch msg := payload.(type) {
+	case nil:
+	case proto.Message:
+		// A typed nil, such as the response of a failed unary handler, carries no content.
+		if !msg.ProtoReflect().IsValid() {
+			break
+		}
+		original := msg
+		msg = i.redactor.redactMessage(msg)
+		messageName = string(msg.ProtoReflect().Descriptor().FullName())
+		messageTypes = i.typeCollector.collect(msg.ProtoReflect())
+
+		// The hash is computed from the redacted message, so that it does not reveal the redacted values.
+		serialized, _ := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		hash = contentHash(serialized)
+		n := len(serialized)
+		if msg != original {
+			n = proto.Size(original)
+		}
+		size = &n
+
+		msg, truncated = i.truncator.truncateMessage(msg)
+		b, err := i.marshaler.Marshal(msg)
+		if err == nil {
+			content = json.RawMessage(b)
+		} else {
+			// The message cannot be represented as JSON, for example because the type of an Any field
+			// cannot be resolved. The serialized bytes are captured instead, so that the message is not lost.
+			marshalError = err.Error()
+		}
+		if i.rawPayload || content == nil {
+			raw = serialized
+			if truncated != nil {
+				raw, _ = proto.Marshal(msg)
+			}
+		}
+	default:
+		// Payloads of custom codecs can only be captured as raw bytes, without them only the error is captured.
+		// A typed nil, such as the response of a failed unary handler, carries no content.
+		if v := reflect.ValueOf(msg); !i.rawPayload || (v.Kind() == reflect.Pointer && v.IsNil()) {
+			break
+		}
+		messageName = fmt.Sprintf("%T", payload)
+		if b, err := c.marshalRaw(payload); err == nil {
+			raw = b
+			n := len(b)
+			size = &n
+			hash = contentHash(b)
+			if c.codec != nil && c.codec.name == "json" && json.Valid(b) {
+				content = json.RawMessage(b)
+			}
+		}
+	}
+	if messageName == "" && handlerError == nil {
+		return nil, captureDrop
+	}
+	contentOmitted := i.truncator.recordExceeds(content, raw)
+	if contentOmitted {
+		content, raw = nil, nil
+	}
+
+	m := i.newRecord(c, recordMessage, direction)
+	m.Message = messageName
+	m.messageTypes = messageTypes
+	m.Content = content
+	m.Raw = raw
+	m.MarshalError = marshalError
+	m.Size = size
+	m.ContentHash = hash
+	m.Truncated = truncated
+	m.ContentOmitted = contentOmitted
+	if raw != nil && c.codec != nil {
+		m.Codec = c.codec.name
+	}
+	if handlerError != nil {
+		m.Error = fmt.Sprintf("%v", handlerError)
+		m.Status = i.newStatus(handlerError)
 	}
+	if c.streamId == nil && direction != c.startDirection() {
+		m.ElapsedMs = milliseconds(time.Since(c.start))
+	}
+	return m, decision
+}
 
-	var data []byte
-	if data, handlerError = json.Marshal(m); handlerError != nil {
+// writeMessageRecord writes the record of a message, or holds it back until the call ends.
+func (i *GrpcJsonInterceptor) writeMessageRecord(c *call, m *capturedMessage, decision captureDecision) {
+	if decision == captureDefer {
+		if m.Time == "" {
+			m.Time = time.Now().Format(time.RFC3339Nano)
+		}
+		c.mu.Lock()
+		c.tail = append(c.tail, m)
+		if len(c.tail) > c.tailSize {
+			c.tail = c.tail[1:]
+		}
+		c.mu.Unlock()
 		return
 	}
+	i.writer.enqueue(m)
+}
 
-	if _, err := i.output.Write(data); err != nil {
+// emit writes a record other than a message, if the capture rules allow it.
+func (i *GrpcJsonInterceptor) emit(c *call, m *capturedMessage) {
+	if c.rules.decide(c, false, m.Direction) == captureDrop {
 		return
 	}
-	_, _ = i.output.WriteString("\n")
+	i.writer.enqueue(m)
+}
+
+// newRecord creates a record of the call, filled with the fields common to all record types.
+func (i *GrpcJsonInterceptor) newRecord(c *call, recordType recordType, direction direction) *capturedMessage {
+	return &capturedMessage{
+		Type:       recordType,
+		Direction:  direction,
+		Side:       c.side,
+		Source:     i.source,
+		FullMethod: c.method,
+		CallId:     c.id,
+		StreamId:   c.streamId,
+		TraceId:    c.traceId,
+		SpanId:     c.spanId,
+		PeerAddr:   c.peerAddress(),
+		Attempt:    c.attempt,
+	}
+}
+
+// setPeer sets the address of the remote peer, written on the records captured after the call.
+func (c *call) setPeer(addr string) {
+	c.peerAddr.Store(&addr)
+}
+
+func (c *call) peerAddress() string {
+	if addr := c.peerAddr.Load(); addr != nil {
+		return *addr
+	}
+	return "unknown"
+}
+
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "unknown"
+	}
+	return addrString(p.Addr)
+}
+
+func addrString(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.String()
+	}
+	return addr.String()
+}
+
+// clientTarget returns the target of the client connection, matched against the peer of capture rules.
+func clientTarget(cc *grpc.ClientConn) string {
+	if cc == nil {
+		return ""
+	}
+	return cc.Target()
 }
 
 // UnaryServerInterceptor returns a gRPC unary server interceptor that logs the request and response messages as JSON.
 func (i *GrpcJsonInterceptor) UnaryServerInterceptor() func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	// If no output file is provided, return an interceptor that does nothing.
-	if i.output == nil {
+	// If no sink is configured, return an interceptor that does nothing.
+	if i.writer == nil {
 		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 			return handler(ctx, req)
 		}
 	}
 
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		i.writeMessage(ctx, directionReceive, info.FullMethod, req, nil, nil)
+		if !i.enabled.Load() {
+			return handler(ctx, req)
+		}
+		matchPeer := peerAddress(ctx)
+		if i.rules.Load().excludesCall(info.FullMethod, matchPeer) {
+			return handler(ctx, req)
+		}
+
+		c := i.newCall(ctx, info.FullMethod, sideServer, false, matchPeer)
+		i.startCall(ctx, c)
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			i.writeMetadata(c, recordHeader, directionReceive, md)
+			c.codec = serverCodec(md)
+		}
+		i.writeMessage(c, directionReceive, req, nil)
+
+		// Capture the headers and trailers set by the handler with grpc.SetHeader and friends.
+		if sts := grpc.ServerTransportStreamFromContext(ctx); sts != nil {
+			ctx = grpc.NewContextWithServerTransportStream(ctx, &serverTransportStreamWrapper{
+				ServerTransportStream: sts,
+				interceptor:           i,
+				call:                  c,
+			})
+		}
+
 		resp, err := handler(ctx, req)
-		i.writeMessage(ctx, directionSend, info.FullMethod, req, err, nil)
+		i.sendHeader(c, nil)
+		i.writeMessage(c, directionSend, resp, err)
+		i.sendTrailer(c)
+		i.endCall(c, err)
 		return resp, err
 	}
 }
 
 // StreamServerInterceptor returns a gRPC stream server interceptor that logs the request and response messages as JSON.
 func (i *GrpcJsonInterceptor) StreamServerInterceptor() func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	// If no output file is provided, return an interceptor that does nothing.
-	if i.output == nil {
+	// If no sink is configured, return an interceptor that does nothing.
+	if i.writer == nil {
 		return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 			return handler(srv, stream)
 		}
 	}
 
 	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		streamId := atomic.AddInt64(&i.streamId, 1)
+		if !i.enabled.Load() {
+			return handler(srv, stream)
+		}
+		matchPeer := peerAddress(stream.Context())
+		if i.rules.Load().excludesCall(info.FullMethod, matchPeer) {
+			return handler(srv, stream)
+		}
+
+		c := i.newCall(stream.Context(), info.FullMethod, sideServer, true, matchPeer)
+		i.startCall(c.ctx, c)
+		if md, ok := metadata.FromIncomingContext(c.ctx); ok {
+			i.writeMetadata(c, recordHeader, directionReceive, md)
+			c.codec = serverCodec(md)
+		}
+
+		// Capture the headers and trailers set by the handler with grpc.SetHeader and friends.
+		if sts := grpc.ServerTransportStreamFromContext(c.ctx); sts != nil {
+			c.ctx = grpc.NewContextWithServerTransportStream(c.ctx, &serverTransportStreamWrapper{
+				ServerTransportStream: sts,
+				interceptor:           i,
+				call:                  c,
+			})
+		}
 
 		wrapper := &serverStreamWrapper{
 			ServerStream: stream,
-			info:         info,
 			interceptor:  i,
-			streamId:     streamId,
+			call:         c,
 		}
 
-		return handler(srv, wrapper)
+		err := handler(srv, wrapper)
+		i.sendHeader(c, nil)
+		i.sendTrailer(c)
+		i.endCall(c, err)
+		return err
 	}
 }
 
 // UnaryClientInterceptor returns a gRPC unary client interceptor that logs the request and response messages as JSON.
 func (i *GrpcJsonInterceptor) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
-	// If no output file is provided, return an interceptor that does nothing.
-	if i.output == nil {
+	// If no sink is configured, return an interceptor that does nothing.
+	if i.writer == nil {
 		return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 			return invoker(ctx, method, req, reply, cc, opts...)
 		}
 	}
 
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		i.writeMessage(ctx, directionReceive, method, req, nil, nil)
-		err := invoker(ctx, method, req, reply, cc, opts...)
-		i.writeMessage(ctx, directionSend, method, reply, err, nil)
+		if !i.enabled.Load() {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		matchPeer := clientTarget(cc)
+		if i.rules.Load().excludesCall(method, matchPeer) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		c := i.newCall(ctx, method, sideClient, false, matchPeer)
+		c.codec = clientCodec(opts)
+		i.startCall(ctx, c)
+		if md, ok := metadata.FromOutgoingContext(ctx); ok {
+			i.writeMetadata(c, recordHeader, directionSend, md)
+		}
+		i.writeMessage(c, directionSend, req, nil)
+
+		var header, trailer metadata.MD
+		var p peer.Peer
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header), grpc.Trailer(&trailer), grpc.Peer(&p))...)
+		if err != nil {
+			// The reply is not populated when the call fails.
+			reply = nil
+		}
+		// The peer is known only after the call, the request was captured without it.
+		if p.Addr != nil {
+			c.setPeer(addrString(p.Addr))
+		}
+		i.recvHeader(c, header)
+		i.writeMessage(c, directionReceive, reply, err)
+		i.recvTrailer(c, trailer)
+		i.endCall(c, err)
 		return err
 	}
 }
 
 // StreamClientInterceptor returns a gRPC stream client interceptor that logs the request and response messages as JSON.
 func (i *GrpcJsonInterceptor) StreamClientInterceptor() grpc.StreamClientInterceptor {
-	// If no output file is provided, return an interceptor that does nothing.
-	if i.output == nil {
+	// If no sink is configured, return an interceptor that does nothing.
+	if i.writer == nil {
 		return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
 			return streamer(ctx, desc, cc, method, opts...)
 		}
 	}
 
 	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-		streamId := atomic.AddInt64(&i.streamId, 1)
+		if !i.enabled.Load() {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		matchPeer := clientTarget(cc)
+		if i.rules.Load().excludesCall(method, matchPeer) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		c := i.newCall(ctx, method, sideClient, true, matchPeer)
+		c.codec = clientCodec(opts)
+		i.startCall(ctx, c)
+		if md, ok := metadata.FromOutgoingContext(ctx); ok {
+			i.writeMetadata(c, recordHeader, directionSend, md)
+		}
 
-		clientStream, err := streamer(ctx, desc, cc, method, opts...)
+		p := &peer.Peer{}
+		clientStream, err := streamer(ctx, desc, cc, method, append(opts, grpc.Peer(p))...)
 		if err != nil {
+			i.endCall(c, err)
 			return nil, err
 		}
+		// The context of the stream carries the peer address, if the stream is already on a connection.
+		// Otherwise the peer is known when the stream ends.
+		if addr := peerAddress(clientStream.Context()); addr != "unknown" {
+			c.setPeer(addr)
+		}
 
 		wrappedStream := &clientStreamWrapper{
 			ClientStream: clientStream,
 			interceptor:  i,
-			method:       method,
-			streamId:     streamId,
+			call:         c,
+			desc:         desc,
+			peer:         p,
 		}
 
 		return wrappedStream, nil
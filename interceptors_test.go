@@ -0,0 +1,670 @@
+package grpc_json_sniffer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/tsaarni/grpc-json-sniffer/example/demo"
+)
+
+// The test service has a method for each kind of call. A request with the name "fail" fails the call.
+// A unary request with the name "retry" fails with Unavailable, unless the call is retried.
+var testServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Test",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Unary", Handler: testUnaryHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "ClientStream", Handler: testClientStreamHandler, ClientStreams: true},
+		{StreamName: "ServerStream", Handler: testServerStreamHandler, ServerStreams: true},
+		{StreamName: "Bidi", Handler: testBidiHandler, ClientStreams: true, ServerStreams: true},
+	},
+}
+
+var (
+	clientStreamDesc = &testServiceDesc.Streams[0]
+	serverStreamDesc = &testServiceDesc.Streams[1]
+	bidiDesc         = &testServiceDesc.Streams[2]
+)
+
+var errTestFailed = status.Error(codes.InvalidArgument, "test failed")
+
+func reply(req *demo.HelloRequest) (*demo.HelloReply, error) {
+	if req.GetName() == "fail" {
+		return nil, errTestFailed
+	}
+	return &demo.HelloReply{Message: "hello " + req.GetName()}, nil
+}
+
+// setTestMetadata sets a header and a trailer, so that both are captured.
+func setTestMetadata(ctx context.Context) {
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-header", "h"))
+	_ = grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "t"))
+}
+
+func testUnaryHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := &demo.HelloRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		// Headers would commit the call and prevent the retry.
+		if md, _ := metadata.FromIncomingContext(ctx); req.(*demo.HelloRequest).GetName() == "retry" && len(md.Get("grpc-previous-rpc-attempts")) == 0 {
+			return nil, status.Error(codes.Unavailable, "try again")
+		}
+		setTestMetadata(ctx)
+		return reply(req.(*demo.HelloRequest))
+	}
+	if interceptor == nil {
+		return handler(ctx, req)
+	}
+	return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Test/Unary"}, handler)
+}
+
+func testClientStreamHandler(_ any, stream grpc.ServerStream) error {
+	setTestMetadata(stream.Context())
+	var names []string
+	for {
+		req := &demo.HelloRequest{}
+		err := stream.RecvMsg(req)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		names = append(names, req.GetName())
+	}
+	resp, err := reply(&demo.HelloRequest{Name: strings.Join(names, ",")})
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(resp)
+}
+
+func testServerStreamHandler(_ any, stream grpc.ServerStream) error {
+	setTestMetadata(stream.Context())
+	req := &demo.HelloRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	for range 2 {
+		resp, err := reply(req)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testBidiHandler(_ any, stream grpc.ServerStream) error {
+	setTestMetadata(stream.Context())
+	for {
+		req := &demo.HelloRequest{}
+		err := stream.RecvMsg(req)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := reply(req)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// newTestInterceptor returns an interceptor capturing to memory.
+func newTestInterceptor(t *testing.T, options ...func(*grpcJsonInterceptorOptions)) (*GrpcJsonInterceptor, *MemorySink) {
+	t.Helper()
+	t.Setenv("GRPC_JSON_SNIFFER_FILE", "")
+	t.Setenv("GRPC_JSON_SNIFFER_ADDR", "")
+	t.Setenv("GRPC_JSON_SNIFFER_RULES", "")
+	t.Setenv("GRPC_JSON_SNIFFER_ENABLED", "")
+	t.Setenv("GRPC_JSON_SNIFFER_BUFFER", "")
+
+	sink := NewMemorySink()
+	i, err := NewGrpcJsonInterceptor(append([]func(*grpcJsonInterceptorOptions){WithSink(sink)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = i.Close(context.Background()) })
+	return i, sink
+}
+
+// startTestServer serves the test services over an in-process connection.
+// The returned function stops the server, after waiting for the calls in progress to complete.
+func startTestServer(t *testing.T, serverOptions []grpc.ServerOption, dialOptions ...grpc.DialOption) (*grpc.ClientConn, func()) {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(serverOptions...)
+	server.RegisterService(&testServiceDesc, struct{}{})
+	server.RegisterService(&jsonServiceDesc, struct{}{})
+	go server.Serve(listener) //nolint:errcheck
+
+	dialOptions = append(dialOptions,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		_ = conn.Close()
+		server.GracefulStop()
+	}
+	t.Cleanup(stop)
+	return conn, stop
+}
+
+// capturedRecords returns the records written by the interceptor, without the capture header and descriptors.
+func capturedRecords(t *testing.T, i *GrpcJsonInterceptor, sink *MemorySink) []map[string]any {
+	t.Helper()
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]any
+	for _, line := range sink.Records() {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid record %s: %v", line, err)
+		}
+		if record["type"] == string(recordCapture) || record["type"] == string(recordDescriptors) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// recordKinds describes each record by its type and direction, and the message type of message records.
+func recordKinds(records []map[string]any) []string {
+	var kinds []string
+	for _, r := range records {
+		kind := r["type"].(string)
+		if d, ok := r["direction"].(string); ok {
+			kind += " " + d
+		}
+		if m, ok := r["message"].(string); ok {
+			kind += " " + m
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+func findRecord(records []map[string]any, recordType recordType) map[string]any {
+	for _, r := range records {
+		if r["type"] == string(recordType) {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestClientStreamEnd(t *testing.T) {
+	i, sink := newTestInterceptor(t)
+	conn, _ := startTestServer(t, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+
+	// The call is not cancelled, so only the response can end it.
+	stream, err := conn.NewStream(context.Background(), clientStreamDesc, "/test.Test/ClientStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := stream.SendMsg(&demo.HelloRequest{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&demo.HelloReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := capturedRecords(t, i, sink)
+	end := findRecord(records, recordEnd)
+	if end == nil {
+		t.Fatalf("no end record in %v", recordKinds(records))
+	}
+	if end["status"].(map[string]any)["code_name"] != "OK" {
+		t.Errorf("got status %v, want OK", end["status"])
+	}
+	if trailer := findRecord(records, recordTrailer); trailer == nil {
+		t.Errorf("no trailer record in %v", recordKinds(records))
+	}
+}
+
+// waitForRecord waits until a record of the given type has been captured.
+func waitForRecord(t *testing.T, i *GrpcJsonInterceptor, sink *MemorySink, recordType recordType) map[string]any {
+	t.Helper()
+	for range 100 {
+		if r := findRecord(capturedRecords(t, i, sink), recordType); r != nil {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %s record in %v", recordType, recordKinds(capturedRecords(t, i, sink)))
+	return nil
+}
+
+func TestClientStreamCancel(t *testing.T) {
+	i, sink := newTestInterceptor(t)
+	conn, _ := startTestServer(t, nil, grpc.WithStreamInterceptor(i.StreamClientInterceptor()))
+
+	// The stream is abandoned after the first response.
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := conn.NewStream(ctx, serverStreamDesc, "/test.Test/ServerStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&demo.HelloRequest{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(&demo.HelloReply{}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	end := waitForRecord(t, i, sink, recordEnd)
+	if code := end["status"].(map[string]any)["code_name"]; code != codes.Canceled.String() {
+		t.Errorf("got status code %v, want %v", code, codes.Canceled)
+	}
+	if cancelRecord := findRecord(capturedRecords(t, i, sink), recordCancel); cancelRecord == nil {
+		t.Error("no cancel record")
+	}
+}
+
+// callKind runs a call of one kind from the client.
+type callKind struct {
+	name   string
+	method string
+	invoke func(ctx context.Context, conn *grpc.ClientConn) error
+}
+
+var callKinds = []callKind{
+	{
+		name:   "unary",
+		method: "/test.Test/Unary",
+		invoke: func(ctx context.Context, conn *grpc.ClientConn) error {
+			return conn.Invoke(ctx, "/test.Test/Unary", &demo.HelloRequest{Name: "a"}, &demo.HelloReply{})
+		},
+	},
+	{
+		name:   "client stream",
+		method: "/test.Test/ClientStream",
+		invoke: func(ctx context.Context, conn *grpc.ClientConn) error {
+			stream, err := conn.NewStream(ctx, clientStreamDesc, "/test.Test/ClientStream")
+			if err != nil {
+				return err
+			}
+			for _, name := range []string{"a", "b"} {
+				if err := stream.SendMsg(&demo.HelloRequest{Name: name}); err != nil {
+					return err
+				}
+			}
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			return stream.RecvMsg(&demo.HelloReply{})
+		},
+	},
+	{
+		name:   "server stream",
+		method: "/test.Test/ServerStream",
+		invoke: func(ctx context.Context, conn *grpc.ClientConn) error {
+			stream, err := conn.NewStream(ctx, serverStreamDesc, "/test.Test/ServerStream")
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(&demo.HelloRequest{Name: "a"}); err != nil {
+				return err
+			}
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			return recvAll(stream)
+		},
+	},
+	{
+		name:   "bidi",
+		method: "/test.Test/Bidi",
+		invoke: func(ctx context.Context, conn *grpc.ClientConn) error {
+			stream, err := conn.NewStream(ctx, bidiDesc, "/test.Test/Bidi")
+			if err != nil {
+				return err
+			}
+			for _, name := range []string{"a", "b"} {
+				if err := stream.SendMsg(&demo.HelloRequest{Name: name}); err != nil {
+					return err
+				}
+				if err := stream.RecvMsg(&demo.HelloReply{}); err != nil {
+					return err
+				}
+			}
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			return recvAll(stream)
+		},
+	},
+}
+
+// recvAll receives the responses until the end of the stream.
+func recvAll(stream grpc.ClientStream) error {
+	for {
+		err := stream.RecvMsg(&demo.HelloReply{})
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// interceptorOptions installs the interceptors on the given side of the test connection.
+func interceptorOptions(i *GrpcJsonInterceptor, side side) ([]grpc.ServerOption, []grpc.DialOption) {
+	if side == sideServer {
+		return []grpc.ServerOption{
+			grpc.UnaryInterceptor(i.UnaryServerInterceptor()),
+			grpc.StreamInterceptor(i.StreamServerInterceptor()),
+		}, nil
+	}
+	return nil, []grpc.DialOption{
+		grpc.WithUnaryInterceptor(i.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(i.StreamClientInterceptor()),
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	tests := []struct {
+		kind     string
+		side     side
+		want     []string
+		sent     float64
+		received float64
+	}{
+		{
+			kind: "unary",
+			side: sideServer,
+			want: []string{
+				"start recv", "header recv", "message recv demo.HelloRequest",
+				"header send", "message send demo.HelloReply", "trailer send", "end send",
+			},
+			sent: 1, received: 1,
+		},
+		{
+			kind: "unary",
+			side: sideClient,
+			want: []string{
+				"start send", "header send", "message send demo.HelloRequest",
+				"header recv", "message recv demo.HelloReply", "trailer recv", "end recv",
+			},
+			sent: 1, received: 1,
+		},
+		{
+			kind: "client stream",
+			side: sideServer,
+			want: []string{
+				"start recv", "header recv", "message recv demo.HelloRequest", "message recv demo.HelloRequest", "half_close recv",
+				"header send", "message send demo.HelloReply", "trailer send", "end send",
+			},
+			sent: 1, received: 2,
+		},
+		{
+			kind: "client stream",
+			side: sideClient,
+			want: []string{
+				"start send", "header send", "message send demo.HelloRequest", "message send demo.HelloRequest", "half_close send",
+				"header recv", "message recv demo.HelloReply", "trailer recv", "end recv",
+			},
+			sent: 2, received: 1,
+		},
+		{
+			kind: "server stream",
+			side: sideServer,
+			want: []string{
+				"start recv", "header recv", "message recv demo.HelloRequest",
+				"header send", "message send demo.HelloReply", "message send demo.HelloReply", "trailer send", "end send",
+			},
+			sent: 2, received: 1,
+		},
+		{
+			kind: "server stream",
+			side: sideClient,
+			want: []string{
+				"start send", "header send", "message send demo.HelloRequest", "half_close send",
+				"header recv", "message recv demo.HelloReply", "message recv demo.HelloReply", "trailer recv", "end recv",
+			},
+			sent: 1, received: 2,
+		},
+		{
+			kind: "bidi",
+			side: sideServer,
+			want: []string{
+				"start recv", "header recv",
+				"message recv demo.HelloRequest", "header send", "message send demo.HelloReply",
+				"message recv demo.HelloRequest", "message send demo.HelloReply",
+				"half_close recv", "trailer send", "end send",
+			},
+			sent: 2, received: 2,
+		},
+		{
+			kind: "bidi",
+			side: sideClient,
+			want: []string{
+				"start send", "header send",
+				"message send demo.HelloRequest", "header recv", "message recv demo.HelloReply",
+				"message send demo.HelloRequest", "message recv demo.HelloReply",
+				"half_close send", "trailer recv", "end recv",
+			},
+			sent: 2, received: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+string(tt.side), func(t *testing.T) {
+			var kind callKind
+			for _, k := range callKinds {
+				if k.name == tt.kind {
+					kind = k
+				}
+			}
+
+			i, sink := newTestInterceptor(t)
+			serverOptions, dialOptions := interceptorOptions(i, tt.side)
+			conn, stop := startTestServer(t, serverOptions, dialOptions...)
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request", "r")
+			if err := kind.invoke(ctx, conn); err != nil {
+				t.Fatal(err)
+			}
+			// The server writes the end of the call after the client has received the response.
+			stop()
+
+			records := capturedRecords(t, i, sink)
+			if got := recordKinds(records); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got records\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+
+			callId := records[0]["call_id"]
+			if callId == nil || callId == 0.0 {
+				t.Errorf("no call_id in %v", records[0])
+			}
+			for n, r := range records {
+				if r["side"] != string(tt.side) || r["method"] != kind.method || r["call_id"] != callId {
+					t.Errorf("got side %v, method %v, call_id %v in %v", r["side"], r["method"], r["call_id"], r)
+				}
+				if n > 0 && r["message_id"].(float64) <= records[n-1]["message_id"].(float64) {
+					t.Errorf("message_id %v does not follow %v", r["message_id"], records[n-1]["message_id"])
+				}
+				if streamId, ok := r["stream_id"]; (kind.name != "unary") != ok || (ok && streamId != callId) {
+					t.Errorf("got stream_id %v with call_id %v in %v", streamId, callId, r)
+				}
+				// Only the response of a unary call has the elapsed time.
+				_, elapsed := r["elapsed_ms"]
+				response := r["type"] == string(recordMessage) && r["message"] == "demo.HelloReply"
+				if elapsed != (kind.name == "unary" && response) {
+					t.Errorf("unexpected elapsed_ms in %v", r)
+				}
+			}
+
+			assertMetadata(t, findRecord(records, recordHeader), "x-request", "r")
+			assertMetadata(t, records[len(records)-2], "x-trailer", "t")
+			for _, r := range records {
+				if r["type"] == string(recordHeader) && r["direction"] == string(directionReceive) && tt.side == sideClient {
+					assertMetadata(t, r, "x-header", "h")
+				}
+				if r["type"] == string(recordHeader) && r["direction"] == string(directionSend) && tt.side == sideServer {
+					assertMetadata(t, r, "x-header", "h")
+				}
+			}
+
+			// The client knows the peer once the call is on a connection.
+			for _, r := range records {
+				if r["peer_address"] != "bufconn" && (tt.side == sideServer || r["type"] == string(recordEnd) || r["direction"] == string(directionReceive)) {
+					t.Errorf("got peer_address %v in %v", r["peer_address"], r)
+				}
+			}
+
+			end := records[len(records)-1]
+			if code := end["status"].(map[string]any)["code_name"]; code != codes.OK.String() {
+				t.Errorf("got status %v, want OK", code)
+			}
+			if end["messages_sent"] != tt.sent || end["messages_received"] != tt.received {
+				t.Errorf("got %v sent and %v received messages, want %v and %v", end["messages_sent"], end["messages_received"], tt.sent, tt.received)
+			}
+			if _, ok := end["duration_ms"]; !ok {
+				t.Errorf("no duration_ms in %v", end)
+			}
+		})
+	}
+}
+
+func assertMetadata(t *testing.T, record map[string]any, key, value string) {
+	t.Helper()
+	md, _ := record["metadata"].(map[string]any)
+	if values, _ := md[key].([]any); len(values) != 1 || values[0] != value {
+		t.Errorf("got %s %v, want %q in %v", key, md[key], value, record)
+	}
+}
+
+func TestInterceptorsFailedCall(t *testing.T) {
+	for _, kind := range callKinds {
+		for _, side := range []side{sideServer, sideClient} {
+			t.Run(kind.name+" "+string(side), func(t *testing.T) {
+				i, sink := newTestInterceptor(t)
+				serverOptions, dialOptions := interceptorOptions(i, side)
+				conn, stop := startTestServer(t, serverOptions, dialOptions...)
+
+				// The first request fails the call.
+				err := failingInvoke(context.Background(), conn, kind)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Fatalf("got error %v, want %v", err, errTestFailed)
+				}
+				stop()
+
+				records := capturedRecords(t, i, sink)
+				end := records[len(records)-1]
+				if end["type"] != string(recordEnd) {
+					t.Fatalf("last record is not the end of the call: %v", recordKinds(records))
+				}
+				st := end["status"].(map[string]any)
+				if st["code_name"] != codes.InvalidArgument.String() || st["message"] != "test failed" || end["error"] != "test failed" {
+					t.Errorf("got status %v and error %v", st, end["error"])
+				}
+				// The failed unary call records the error in place of the response.
+				if kind.name == "unary" {
+					response := records[len(records)-3]
+					st, _ := response["status"].(map[string]any)
+					if response["type"] != string(recordMessage) || response["message"] != nil || st["code_name"] != codes.InvalidArgument.String() {
+						t.Errorf("got response %v, want the error", response)
+					}
+				}
+			})
+		}
+	}
+}
+
+// failingInvoke runs a call of the given kind whose request fails it.
+func failingInvoke(ctx context.Context, conn *grpc.ClientConn, kind callKind) error {
+	if kind.name == "unary" {
+		return conn.Invoke(ctx, kind.method, &demo.HelloRequest{Name: "fail"}, &demo.HelloReply{})
+	}
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, kind.method)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&demo.HelloRequest{Name: "fail"}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return recvAll(stream)
+}
+
+func TestMarshalFallback(t *testing.T) {
+	i, _ := newTestInterceptor(t)
+	c := i.newCall(context.Background(), "/test.Test/Unary", sideServer, false, "")
+
+	resolvable := &spb.Status{Details: []*anypb.Any{mustAny(t, &demo.HelloRequest{Name: "a"})}}
+	m, _ := i.newMessageRecord(c, directionSend, resolvable, nil)
+	if m.Content == nil || m.Raw != nil || m.MarshalError != "" {
+		t.Errorf("got content %s, raw %v and marshal_error %q, want only content", m.Content, m.Raw, m.MarshalError)
+	}
+
+	// The type of the Any cannot be resolved, so the message cannot be converted to JSON.
+	unresolvable := &spb.Status{Details: []*anypb.Any{{TypeUrl: "type.googleapis.com/unknown.Type", Value: []byte{0x0a, 0x01, 'x'}}}}
+	m, _ = i.newMessageRecord(c, directionSend, unresolvable, nil)
+	want, err := proto.MarshalOptions{Deterministic: true}.Marshal(unresolvable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Content != nil || !bytes.Equal(m.Raw, want) || !strings.Contains(m.MarshalError, "unknown.Type") {
+		t.Errorf("got content %s, raw %v and marshal_error %q, want raw and the error", m.Content, m.Raw, m.MarshalError)
+	}
+	if m.Message != "google.rpc.Status" || m.Size == nil || *m.Size != len(want) {
+		t.Errorf("got message %q and size %v", m.Message, m.Size)
+	}
+}
+
+func TestMarshalOptionsMultiline(t *testing.T) {
+	t.Setenv("GRPC_JSON_SNIFFER_FILE", "")
+	for _, options := range []protojson.MarshalOptions{{Multiline: true}, {Indent: "  "}} {
+		if _, err := NewGrpcJsonInterceptor(WithSink(NewMemorySink()), WithMarshalOptions(options)); err == nil {
+			t.Errorf("no error for %+v", options)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// startCall captures the start of the call, with its deadline, and starts watching for cancellation.
+//
+// The cancellation is watched from ctx, which is the context given by the application (client) or by
+// gRPC (server), instead of the context of the stream that gRPC cancels also when the call completes normally.
+func (i *GrpcJsonInterceptor) startCall(ctx context.Context, c *call) {
+	c.start = time.Now()
+	i.emit(c, i.newStartRecord(ctx, c))
+	i.watchCancel(ctx, c)
+}
+
+// newStartRecord creates the record of the call start, with the deadline of the context.
+func (i *GrpcJsonInterceptor) newStartRecord(ctx context.Context, c *call) *capturedMessage {
+	m := i.newRecord(c, recordStart, c.startDirection())
+	if deadline, ok := ctx.Deadline(); ok {
+		m.Deadline = deadline.Format(time.RFC3339Nano)
+		m.TimeoutMs = milliseconds(time.Until(deadline))
+	}
+	return m
+}
+
+// watchCancel captures the cancellation of ctx before the call ends.
+func (i *GrpcJsonInterceptor) watchCancel(ctx context.Context, c *call) {
+	c.stopCancelWatch = context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		if c.ended {
+			c.mu.Unlock()
+			return
+		}
+		m := i.newRecord(c, recordCancel, "")
+		m.Cause = context.Cause(ctx).Error()
+		i.emit(c, m)
+		c.mu.Unlock()
+
+		// The application may abandon a cancelled client stream without reading it to the end,
+		// so this may be the last chance to capture the end of the call.
+		if c.side == sideClient && c.streamId != nil {
+			i.endCall(c, status.FromContextError(ctx.Err()).Err())
+		}
+	})
+}
+
+// halfClose captures the client closing its sending side of a stream.
+func (i *GrpcJsonInterceptor) halfClose(c *call, direction direction) {
+	i.emit(c, i.newRecord(c, recordHalfClose, direction))
+}
+
+// endCall captures the end of the call with its final status, duration and message counts.
+// It is safe to call multiple times, the end is captured only once.
+func (i *GrpcJsonInterceptor) endCall(c *call, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended {
+		return
+	}
+	c.ended = true
+	if c.stopCancelWatch != nil {
+		c.stopCancelWatch()
+	}
+
+	// The last messages held back by the capture rules are written before the end of the call.
+	for _, m := range c.tail {
+		i.writer.enqueue(m)
+	}
+	c.tail = nil
+
+	sent := c.sent.Load()
+	received := c.received.Load()
+
+	// The client receives the status from the server, the server sends it.
+	direction := directionSend
+	if c.side == sideClient {
+		direction = directionReceive
+	}
+
+	m := i.newRecord(c, recordEnd, direction)
+	m.Status = i.newStatus(err)
+	if err != nil {
+		m.Error = m.Status.Message
+	}
+	m.DurationMs = milliseconds(time.Since(c.start))
+	m.MessagesSent = &sent
+	m.MessagesReceived = &received
+	i.emit(c, m)
+}
+
+// startDirection returns the direction of the call start: the client sends the request headers
+// that start the call, the server receives them.
+func (c *call) startDirection() direction {
+	if c.side == sideClient {
+		return directionSend
+	}
+	return directionReceive
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
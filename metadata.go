@@ -0,0 +1,173 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadataFilter selects which metadata keys are captured.
+// Keys in the deny list are never captured.
+// If the allow list is not empty, only the keys in the allow list are captured.
+type metadataFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func newMetadataFilter(allow, deny []string) metadataFilter {
+	return metadataFilter{
+		allow: toKeySet(allow),
+		deny:  toKeySet(deny),
+	}
+}
+
+func toKeySet(keys []string) map[string]bool {
+	if len(keys) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[strings.ToLower(k)] = true
+	}
+	return set
+}
+
+// apply returns the captured subset of the metadata.
+// Values of binary headers ("-bin" suffix) are encoded as base64, since they are not valid strings.
+func (f metadataFilter) apply(md metadata.MD) map[string][]string {
+	var captured map[string][]string
+	for k, values := range md {
+		key := strings.ToLower(k)
+		if f.deny[key] || (f.allow != nil && !f.allow[key]) {
+			continue
+		}
+		if captured == nil {
+			captured = make(map[string][]string, len(md))
+		}
+		if strings.HasSuffix(key, "-bin") {
+			encoded := make([]string, len(values))
+			for n, v := range values {
+				encoded[n] = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			values = encoded
+		}
+		captured[key] = append(captured[key], values...)
+	}
+	return captured
+}
+
+// writeMetadata captures the headers or trailers of the call.
+// Nothing is written if all keys were filtered out.
+func (i *GrpcJsonInterceptor) writeMetadata(c *call, recordType recordType, direction direction, md metadata.MD) {
+	m := i.newMetadataRecord(c, recordType, direction, md)
+	if len(m.Metadata) == 0 {
+		return
+	}
+	i.emit(c, m)
+}
+
+// newMetadataRecord creates a record of the headers or trailers, with the filters and redaction applied.
+func (i *GrpcJsonInterceptor) newMetadataRecord(c *call, recordType recordType, direction direction, md metadata.MD) *capturedMessage {
+	captured := i.metadataFilter.apply(md)
+	i.redactor.redactMetadata(captured)
+	m := i.newRecord(c, recordType, direction)
+	m.Metadata = captured
+	return m
+}
+
+// setHeader records headers set by a server handler.
+// They are captured when the headers are sent.
+func (i *GrpcJsonInterceptor) setHeader(c *call, md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header = metadata.Join(c.header, md)
+}
+
+// sendHeader captures the headers sent by a server handler.
+// It is safe to call multiple times, the headers are captured only once.
+func (i *GrpcJsonInterceptor) sendHeader(c *call, md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.headerCaptured {
+		return
+	}
+	c.headerCaptured = true
+	i.writeMetadata(c, recordHeader, directionSend, metadata.Join(c.header, md))
+}
+
+// setTrailer records trailers set by a server handler.
+// They are captured when the call ends.
+func (i *GrpcJsonInterceptor) setTrailer(c *call, md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trailer = metadata.Join(c.trailer, md)
+}
+
+// sendTrailer captures the trailers of a server handler when the call ends.
+func (i *GrpcJsonInterceptor) sendTrailer(c *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trailerCaptured {
+		return
+	}
+	c.trailerCaptured = true
+	i.writeMetadata(c, recordTrailer, directionSend, c.trailer)
+}
+
+// recvHeader captures the headers received by a client.
+// It is safe to call multiple times, the headers are captured only once.
+func (i *GrpcJsonInterceptor) recvHeader(c *call, md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.headerCaptured {
+		return
+	}
+	c.headerCaptured = true
+	i.writeMetadata(c, recordHeader, directionReceive, md)
+}
+
+// recvTrailer captures the trailers received by a client.
+// It is safe to call multiple times, the trailers are captured only once.
+func (i *GrpcJsonInterceptor) recvTrailer(c *call, md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trailerCaptured {
+		return
+	}
+	c.trailerCaptured = true
+	i.writeMetadata(c, recordTrailer, directionReceive, md)
+}
+
+// serverTransportStreamWrapper captures the headers and trailers that a handler sets with
+// grpc.SetHeader, grpc.SendHeader and grpc.SetTrailer.
+type serverTransportStreamWrapper struct {
+	grpc.ServerTransportStream
+	interceptor *GrpcJsonInterceptor
+	call        *call
+}
+
+func (w *serverTransportStreamWrapper) SetHeader(md metadata.MD) error {
+	err := w.ServerTransportStream.SetHeader(md)
+	if err == nil {
+		w.interceptor.setHeader(w.call, md)
+	}
+	return err
+}
+
+func (w *serverTransportStreamWrapper) SendHeader(md metadata.MD) error {
+	err := w.ServerTransportStream.SendHeader(md)
+	if err == nil {
+		w.interceptor.sendHeader(w.call, md)
+	}
+	return err
+}
+
+func (w *serverTransportStreamWrapper) SetTrailer(md metadata.MD) error {
+	err := w.ServerTransportStream.SetTrailer(md)
+	if err == nil {
+		w.interceptor.setTrailer(w.call, md)
+	}
+	return err
+}
@@ -5,6 +5,9 @@ export class GrpcViewer {
   constructor() {
     this.messages = [];
 
+    // Message types described by the descriptors in the capture, by their fully qualified name.
+    this.messageTypes = new Map();
+
     // Templates
     this.messageListTemplate = document.getElementById(
       'message-list-template'
@@ -39,8 +42,12 @@ export class GrpcViewer {
 
     this.timeZone = localStorage.getItem('grpc-viewer-timezone') || undefined;
 
+    // URL template linking trace IDs to a tracing UI, from the viewer configuration.
+    this.traceUrl = null;
+
     this.initializeEventListeners();
     this.initializeResizer();
+    this.initializeConfig();
     this.initializeWebSocket();
 
     this.selectedMessageId = null;
@@ -48,14 +55,42 @@ export class GrpcViewer {
     // Initialize CEL environment with type-safe variable declarations
     this.celEnv = new Environment()
       .registerVariable('message_id', 'dyn')
+      .registerVariable('type', 'string')
+      .registerVariable('call_id', 'dyn')
       .registerVariable('stream_id', 'dyn')
+      .registerVariable('trace_id', 'string')
+      .registerVariable('span_id', 'string')
       .registerVariable('direction', 'string')
+      .registerVariable('side', 'string')
+      .registerVariable('source', 'string')
       .registerVariable('time', 'string')
       .registerVariable('method', 'string')
       .registerVariable('message', 'string')
       .registerVariable('peer_address', 'string')
       .registerVariable('content', 'dyn')
-      .registerVariable('error', 'string');
+      .registerVariable('metadata', 'dyn')
+      .registerVariable('error', 'string')
+      .registerVariable('status', 'dyn')
+      .registerVariable('deadline', 'string')
+      .registerVariable('timeout_ms', 'dyn')
+      .registerVariable('duration_ms', 'dyn')
+      .registerVariable('messages_sent', 'dyn')
+      .registerVariable('messages_received', 'dyn')
+      .registerVariable('cause', 'string')
+      .registerVariable('elapsed_ms', 'dyn')
+      .registerVariable('raw', 'string')
+      .registerVariable('codec', 'string')
+      .registerVariable('marshal_error', 'string')
+      .registerVariable('size', 'dyn')
+      .registerVariable('content_hash', 'string')
+      .registerVariable('truncated', 'dyn')
+      .registerVariable('content_omitted', 'bool')
+      .registerVariable('payload_length', 'dyn')
+      .registerVariable('compressed_length', 'dyn')
+      .registerVariable('wire_length', 'dyn')
+      .registerVariable('compression', 'string')
+      .registerVariable('attempt', 'dyn')
+      .registerVariable('transparent_retry', 'bool');
   }
 
   getFilteredMessages() {
@@ -110,9 +145,7 @@ export class GrpcViewer {
         formatTimestamp(msg.time, this.timeZone);
       item.querySelector(
         '.message-row-method-and-message'
-      ).textContent = `${stripNamespace(msg.method)} (${stripNamespace(
-        msg.message
-      )})`;
+      ).textContent = `${stripNamespace(msg.method)} (${describeRecord(msg)})`;
 
       if (msg.direction === 'recv') {
         item.classList.add('recv');
@@ -159,13 +192,100 @@ export class GrpcViewer {
     details
       .querySelector('#message-details-direction-value')
       .appendChild(this.createFilterLink('direction', msg.direction));
+    details
+      .querySelector('#message-details-side-value')
+      .appendChild(this.createFilterLink('side', msg.side));
     details
       .querySelector('#message-details-peer-address-value')
       .appendChild(this.createFilterLink('peer_address', msg.peer_address));
+    details
+      .querySelector('#message-details-type-value')
+      .appendChild(this.createFilterLink('type', msg.type));
     details.querySelector('#message-details-payload-value').textContent =
-      JSON.stringify(msg.content, null, 2);
+      JSON.stringify(recordPayload(msg), null, 2);
 
     // Optional fields.
+    if ('call_id' in msg) {
+      details
+        .querySelector('#message-details-call-id')
+        .classList.remove('hidden');
+      details
+        .querySelector('#message-details-call-id-value')
+        .appendChild(this.createFilterLink('call_id', msg.call_id));
+    }
+    if ('source' in msg) {
+      details
+        .querySelector('#message-details-source')
+        .classList.remove('hidden');
+      details
+        .querySelector('#message-details-source-value')
+        .appendChild(this.createFilterLink('source', msg.source));
+    }
+    if ('elapsed_ms' in msg) {
+      details
+        .querySelector('#message-details-elapsed')
+        .classList.remove('hidden');
+      details.querySelector('#message-details-elapsed-value').textContent =
+        `${msg.elapsed_ms.toFixed(3)} ms`;
+    }
+    if ('raw' in msg) {
+      details.querySelector('#message-details-raw').classList.remove('hidden');
+      details.querySelector('#message-details-raw-value').textContent =
+        'codec' in msg ? `${msg.raw} (${msg.codec})` : msg.raw;
+    }
+    if ('trace_id' in msg) {
+      details.querySelector('#message-details-trace').classList.remove('hidden');
+      const trace = details.querySelector('#message-details-trace-value');
+      trace.appendChild(this.createFilterLink('trace_id', msg.trace_id));
+      if (this.traceUrl) {
+        const link = document.createElement('a');
+        link.href = this.traceUrl
+          .replaceAll('{trace_id}', encodeURIComponent(msg.trace_id))
+          .replaceAll('{span_id}', encodeURIComponent(msg.span_id ?? ''));
+        link.target = '_blank';
+        link.rel = 'noopener';
+        link.textContent = 'open trace';
+        trace.append(' (', link, ')');
+      }
+    }
+    if ('marshal_error' in msg) {
+      details
+        .querySelector('#message-details-marshal-error')
+        .classList.remove('hidden');
+      details.querySelector(
+        '#message-details-marshal-error-value'
+      ).textContent = msg.marshal_error;
+    }
+    if ('content_hash' in msg) {
+      details.querySelector('#message-details-size').classList.remove('hidden');
+      details.querySelector('#message-details-size-value').textContent =
+        `${msg.size ?? 0} bytes, sha256 `;
+      details
+        .querySelector('#message-details-size-value')
+        .appendChild(this.createFilterLink('content_hash', msg.content_hash));
+    }
+    if ('truncated' in msg || 'content_omitted' in msg) {
+      details
+        .querySelector('#message-details-truncated')
+        .classList.remove('hidden');
+      details.querySelector('#message-details-truncated-value').textContent =
+        describeTruncation(msg);
+    }
+    if ('attempt' in msg) {
+      details
+        .querySelector('#message-details-attempt')
+        .classList.remove('hidden');
+      details
+        .querySelector('#message-details-attempt-value')
+        .appendChild(this.createFilterLink('attempt', msg.attempt));
+    }
+    if ('wire_length' in msg || 'compression' in msg) {
+      details
+        .querySelector('#message-details-transport')
+        .classList.remove('hidden');
+      details.querySelector('#message-details-transport-value').textContent =
+        describeTransport(msg);
+    }
     if ('stream_id' in msg) {
       details
         .querySelector('#message-details-stream-id')
@@ -182,11 +302,47 @@ export class GrpcViewer {
       error.classList.add('error');
       details.querySelector('#message-details-error-value').appendChild(error);
     }
+    if ('status' in msg) {
+      details
+        .querySelector('#message-details-status')
+        .classList.remove('hidden');
+      details
+        .querySelector('#message-details-status-value')
+        .appendChild(this.createFilterLink('status.code', msg.status.code));
+      details.querySelector(
+        '#message-details-status-name-value'
+      ).textContent = ` (${msg.status.code_name})`;
+      if (msg.status.details) {
+        details
+          .querySelector('#message-details-status-details')
+          .classList.remove('hidden');
+        details.querySelector(
+          '#message-details-status-details-value'
+        ).textContent = JSON.stringify(msg.status.details, null, 2);
+      }
+    }
+    if (this.messageTypes.has(msg.message)) {
+      details
+        .querySelector('#message-details-schema')
+        .classList.remove('hidden');
+      details.querySelector('#message-details-schema-value').textContent =
+        formatMessageType(msg.message, this.messageTypes.get(msg.message));
+    }
 
     this.detailsContent.innerHTML = '';
     this.detailsContent.appendChild(details);
   }
 
+  addDescriptors(descriptorSet) {
+    for (const file of descriptorSet?.file ?? []) {
+      addMessageTypes(
+        this.messageTypes,
+        file.package ? `${file.package}.` : '',
+        file.messageType
+      );
+    }
+  }
+
   createFilterLink(key, value) {
     const link = document.createElement('a');
     link.href = '#';
@@ -198,6 +354,44 @@ export class GrpcViewer {
     return link;
   }
 
+  // Asks the server to send only the records matching the filter, once the user has stopped typing.
+  // The records are received again from the start, since the earlier ones were filtered with the old filter.
+  delayedApplyServerFilter() {
+    clearTimeout(this.serverFilterTimer);
+    this.serverFilterTimer = setTimeout(() => this.applyServerFilter(), 1000);
+  }
+
+  async applyServerFilter() {
+    const filterQuery = this.filterInput.value.trim();
+    if (filterQuery === this.serverFilter) {
+      return;
+    }
+    if (filterQuery) {
+      // The server checks the filter before the websocket is reconnected with it.
+      try {
+        const response = await fetch(
+          `/api/filter?filter=${encodeURIComponent(filterQuery)}`
+        );
+        if (!response.ok) {
+          this.filterInput.classList.add('filter-error');
+          this.filterErrorTooltip.textContent = await response.text();
+          return;
+        }
+      } catch (error) {
+        console.error('Failed to check the filter', error);
+        return;
+      }
+      if (this.filterInput.value.trim() !== filterQuery) {
+        return;
+      }
+    }
+    this.serverFilter = filterQuery;
+    this.messages = [];
+    this.lastMessageId = 0;
+    this.socketClient.reconnect();
+    this.delayedRenderMessageList();
+  }
+
   clearMessages() {
     this.messages = [];
     this.renderMessageList();
@@ -208,11 +402,13 @@ export class GrpcViewer {
   initializeEventListeners() {
     this.filterInput.addEventListener('input', () => {
       this.delayedRenderMessageList();
+      this.delayedApplyServerFilter();
     });
 
     this.filterInputClearButton.addEventListener('click', () => {
       this.filterInput.value = '';
       this.delayedRenderMessageList();
+      this.delayedApplyServerFilter();
     });
 
     this.clearButton.addEventListener('click', () => {
@@ -257,10 +453,42 @@ export class GrpcViewer {
     });
   }
 
+  initializeConfig() {
+    fetch('/config')
+      .then((response) => response.json())
+      .then((config) => {
+        this.traceUrl = config.trace_url ?? null;
+      })
+      .catch((error) => {
+        console.error('Failed to load viewer configuration', error);
+      });
+  }
+
   initializeWebSocket() {
     const wsHost = window.location.host;
     const wsUrl = `ws://${wsHost}/messages`;
-    this.socketClient = new WebSocketClient(wsUrl, (msg) => {
+    // After a reconnect, the stream continues from the last record received.
+    this.lastMessageId = 0;
+    // The server sends only the records matching the filter.
+    this.serverFilter = '';
+    const getUrl = () => {
+      const params = new URLSearchParams();
+      if (this.lastMessageId > 0) {
+        params.set('after', this.lastMessageId);
+      }
+      if (this.serverFilter) {
+        params.set('filter', this.serverFilter);
+      }
+      const query = params.toString();
+      return query ? `${wsUrl}?${query}` : wsUrl;
+    };
+    this.socketClient = new WebSocketClient(getUrl, (msg) => {
+      // The capture header and descriptors describe the capture, they are not shown in the list.
+      if (msg.type === 'capture' || msg.type === 'descriptors') {
+        this.addDescriptors(msg.descriptors);
+        return;
+      }
+      this.lastMessageId = msg.message_id;
       this.messages.push(msg);
       this.delayedRenderMessageList();
     });
@@ -360,6 +588,108 @@ function formatTimestamp(timeStamp, timeZone) {
   });
 }
 
+// Returns the message type for message records, or the record type for other records.
+function describeRecord(msg) {
+  if (!msg.type || msg.type === 'message') {
+    return stripNamespace(msg.message ?? '');
+  }
+  return msg.type;
+}
+
+// Fields shown in the metadata section of the message details.
+const commonFields = new Set([
+  'message_id',
+  'call_id',
+  'stream_id',
+  'trace_id',
+  'span_id',
+  'type',
+  'direction',
+  'side',
+  'source',
+  'time',
+  'method',
+  'message',
+  'peer_address',
+  'error',
+  'status',
+  'elapsed_ms',
+  'raw',
+  'codec',
+  'marshal_error',
+  'size',
+  'content_hash',
+  'truncated',
+  'content_omitted',
+  'payload_length',
+  'compressed_length',
+  'wire_length',
+  'compression',
+  'attempt',
+]);
+
+// Returns the payload shown in the message details: message content, headers and trailers,
+// or the remaining fields of call lifecycle records.
+function recordPayload(msg) {
+  if ('content' in msg) {
+    return msg.content;
+  }
+  if ('metadata' in msg) {
+    return msg.metadata;
+  }
+  return Object.fromEntries(
+    Object.entries(msg).filter(([key]) => !commonFields.has(key))
+  );
+}
+
+// Describes the fields shortened by the size limits of the capture.
+function describeTruncation(msg) {
+  const parts = (msg.truncated ?? []).map(
+    (field) => `${field.path} (${field.length})`
+  );
+  if (msg.content_omitted) {
+    parts.push('content omitted, larger than the maximum record size');
+  }
+  return parts.join(', ');
+}
+
+// Describes the sizes and compression seen by the stats handler.
+function describeTransport(msg) {
+  const parts = [];
+  if ('wire_length' in msg) {
+    parts.push(`${msg.wire_length} bytes on the wire`);
+  }
+  if (msg.type === 'message') {
+    parts.push(`${msg.payload_length ?? 0} bytes uncompressed`);
+    parts.push(`${msg.compressed_length ?? 0} bytes compressed`);
+  }
+  if ('compression' in msg) {
+    parts.push(`compression ${msg.compression}`);
+  }
+  return parts.join(', ');
+}
+
+// Adds the message types and their nested types from google.protobuf.DescriptorProto in JSON to the map.
+function addMessageTypes(types, prefix, messageTypes) {
+  for (const messageType of messageTypes ?? []) {
+    const name = prefix + messageType.name;
+    types.set(name, messageType);
+    addMessageTypes(types, `${name}.`, messageType.nestedType);
+  }
+}
+
+// Formats the message type in proto syntax.
+function formatMessageType(name, messageType) {
+  const fields = (messageType.field ?? []).map((field) => {
+    const label = field.label === 'LABEL_REPEATED' ? 'repeated ' : '';
+    const type = field.typeName
+      ? field.typeName.replace(/^\./, '')
+      : field.type.replace(/^TYPE_/, '').toLowerCase();
+    return `  ${label}${type} ${field.name} = ${field.number};`;
+  });
+  return `message ${stripNamespace(name)} {\n${fields.join('\n')}\n}`;
+}
+
 function stripNamespace(method) {
   const parts1 = method.split('/');
   const lastPart = parts1[parts1.length - 1];
@@ -1,23 +1,45 @@
+// The server sends a heartbeat every 15 seconds when there are no records to send.
+// A connection that has been silent for longer is considered dead.
+const heartbeatTimeout = 40 * 1000;
+
+const minReconnectDelay = 1000;
+const maxReconnectDelay = 30 * 1000;
+
+// WebSocketClient receives the captured records, reconnecting when the connection is lost.
+// The URL is asked from getUrl on each connection, so that the stream can resume where it left off.
 export class WebSocketClient {
-  constructor(url, onMessage) {
-    this.url = url;
+  constructor(getUrl, onMessage) {
+    this.getUrl = getUrl;
     this.onMessage = onMessage;
-    this.socket = new WebSocket(url);
+    this.reconnectDelay = minReconnectDelay;
+    this.connect();
+  }
 
-    this.socket.onopen = () => {
+  connect() {
+    const url = this.getUrl();
+    const socket = new WebSocket(url);
+    this.socket = socket;
+
+    socket.onopen = () => {
       console.log('WebSocket connected to ' + url);
+      this.reconnectDelay = minReconnectDelay;
+      this.resetWatchdog();
     };
 
-    this.socket.onmessage = (event) => {
+    socket.onmessage = (event) => {
+      this.resetWatchdog();
       try {
         const msg = JSON.parse(event.data);
+        if (msg.type === 'heartbeat') {
+          return;
+        }
         this.onMessage(msg);
       } catch (e) {
         console.error('Failed to parse message', e);
       }
     };
 
-    this.socket.onclose = (event) => {
+    socket.onclose = (event) => {
       if (event.wasClean) {
         console.log(
           `[close] Connection closed cleanly, code=${event.code} reason=${event.reason}`
@@ -25,10 +47,47 @@ export class WebSocketClient {
       } else {
         console.log('[close] Connection died');
       }
+      clearTimeout(this.watchdog);
+      this.scheduleReconnect();
     };
 
-    this.socket.onerror = (error) => {
+    socket.onerror = (error) => {
       console.log('WebSocket error: ' + error);
     };
   }
+
+  // Closes the connection if nothing is received before the heartbeat timeout.
+  resetWatchdog() {
+    clearTimeout(this.watchdog);
+    this.watchdog = setTimeout(() => {
+      // The closing handshake of a dead connection can take long, reconnect without waiting for it.
+      console.log('[close] No heartbeat from the server');
+      this.detach();
+      this.scheduleReconnect();
+    }, heartbeatTimeout);
+  }
+
+  // Connects again right away, for example when the URL has changed.
+  // Nothing more is received from the current connection.
+  reconnect() {
+    this.detach();
+    clearTimeout(this.reconnectTimer);
+    this.reconnectDelay = minReconnectDelay;
+    this.connect();
+  }
+
+  // Closes the current connection without waiting for it to finish.
+  detach() {
+    clearTimeout(this.watchdog);
+    const socket = this.socket;
+    socket.onmessage = null;
+    socket.onclose = null;
+    socket.close();
+  }
+
+  scheduleReconnect() {
+    console.log(`Reconnecting in ${this.reconnectDelay / 1000} s`);
+    this.reconnectTimer = setTimeout(() => this.connect(), this.reconnectDelay);
+    this.reconnectDelay = Math.min(this.reconnectDelay * 2, maxReconnectDelay);
+  }
 }
@@ -0,0 +1,100 @@
+package grpc_json_sniffer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+)
+
+// rawCodec serializes payloads that are not protobuf messages, using the codec of the call.
+type rawCodec struct {
+	name    string
+	marshal func(v any) ([]byte, error)
+}
+
+func newRawCodecV2(codec encoding.CodecV2) *rawCodec {
+	return &rawCodec{
+		name: codec.Name(),
+		marshal: func(v any) ([]byte, error) {
+			data, err := codec.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			defer data.Free()
+			return data.Materialize(), nil
+		},
+	}
+}
+
+func newRawCodecV1(codec encoding.Codec) *rawCodec {
+	return &rawCodec{
+		name:    codec.Name(),
+		marshal: codec.Marshal,
+	}
+}
+
+// clientCodec returns the codec selected by the call options of a client call.
+func clientCodec(opts []grpc.CallOption) *rawCodec {
+	var codec *rawCodec
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.ForceCodecV2CallOption:
+			codec = newRawCodecV2(o.CodecV2)
+		case grpc.ForceCodecCallOption:
+			codec = newRawCodecV1(o.Codec)
+		case grpc.ContentSubtypeCallOption:
+			if codec == nil {
+				codec = registeredCodec(o.ContentSubtype)
+			}
+		}
+	}
+	return codec
+}
+
+// serverCodec returns the codec registered for the content-subtype of the request,
+// for example "json" for content-type "application/grpc+json".
+func serverCodec(md metadata.MD) *rawCodec {
+	for _, contentType := range md.Get("content-type") {
+		_, subtype, ok := strings.Cut(contentType, "+")
+		if !ok {
+			continue
+		}
+		if codec := registeredCodec(subtype); codec != nil {
+			return codec
+		}
+	}
+	return nil
+}
+
+// registeredCodec returns the codec registered for the content-subtype, either with
+// encoding.RegisterCodecV2 or with encoding.RegisterCodec.
+func registeredCodec(subtype string) *rawCodec {
+	subtype = strings.ToLower(subtype)
+	if codec := encoding.GetCodecV2(subtype); codec != nil {
+		return newRawCodecV2(codec)
+	}
+	if codec := encoding.GetCodec(subtype); codec != nil {
+		return newRawCodecV1(codec)
+	}
+	return nil
+}
+
+// marshalRaw serializes a payload that is not a protobuf message.
+// Byte slices are captured as is, other payloads are serialized with the codec of the call.
+func (c *call) marshalRaw(payload any) ([]byte, error) {
+	// The payload may be reused by the application after the call, so it is copied.
+	switch p := payload.(type) {
+	case []byte:
+		return bytes.Clone(p), nil
+	case *[]byte:
+		return bytes.Clone(*p), nil
+	}
+	if c.codec == nil {
+		return nil, fmt.Errorf("no codec found for payload of type %T", payload)
+	}
+	return c.codec.marshal(payload)
+}
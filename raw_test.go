@@ -0,0 +1,130 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// testJsonCodec serializes plain Go values, which are not protobuf messages.
+type testJsonCodec struct{}
+
+func (testJsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (testJsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (testJsonCodec) Name() string                       { return "testjson" }
+
+func init() {
+	encoding.RegisterCodec(testJsonCodec{})
+}
+
+type jsonRequest struct {
+	Name string `json:"name"`
+}
+
+type jsonReply struct {
+	Message string `json:"message"`
+}
+
+// jsonServiceDesc is a service whose messages are serialized with testJsonCodec.
+var jsonServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Json",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Unary",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := &jsonRequest{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				// Like generated code, a failed handler returns a typed nil.
+				var resp *jsonReply
+				if req.(*jsonRequest).Name == "fail" {
+					return resp, errTestFailed
+				}
+				return &jsonReply{Message: "hello " + req.(*jsonRequest).Name}, nil
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Json/Unary"}, handler)
+		},
+	}},
+}
+
+func TestCustomCodecWithoutRawPayload(t *testing.T) {
+	for _, side := range []side{sideServer, sideClient} {
+		t.Run(string(side), func(t *testing.T) {
+			i, sink := newTestInterceptor(t)
+			serverOptions, dialOptions := interceptorOptions(i, side)
+			conn, stop := startTestServer(t, serverOptions, dialOptions...)
+
+			codec := grpc.CallContentSubtype(testJsonCodec{}.Name())
+			if err := conn.Invoke(context.Background(), "/test.Json/Unary", &jsonRequest{Name: "a"}, &jsonReply{}, codec); err != nil {
+				t.Fatal(err)
+			}
+			err := conn.Invoke(context.Background(), "/test.Json/Unary", &jsonRequest{Name: "fail"}, &jsonReply{}, codec)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("got error %v, want %v", err, errTestFailed)
+			}
+			stop()
+
+			// Without the raw payload, the messages cannot be captured, but the error of the failed call is.
+			var messages []map[string]any
+			for _, r := range capturedRecords(t, i, sink) {
+				if r["type"] == string(recordMessage) {
+					messages = append(messages, r)
+				}
+			}
+			if len(messages) != 1 {
+				t.Fatalf("got message records %v, want only the error", messages)
+			}
+			m := messages[0]
+			st, _ := m["status"].(map[string]any)
+			if m["error"] == nil || st["code_name"] != codes.InvalidArgument.String() {
+				t.Errorf("got error %v and status %v, want %v", m["error"], m["status"], errTestFailed)
+			}
+			for _, field := range []string{"content", "raw", "message"} {
+				if _, ok := m[field]; ok {
+					t.Errorf("unexpected %s in %v", field, m)
+				}
+			}
+		})
+	}
+}
+
+func TestCustomCodecWithRawPayload(t *testing.T) {
+	i, sink := newTestInterceptor(t, WithRawPayload(true))
+	serverOptions, dialOptions := interceptorOptions(i, sideServer)
+	conn, stop := startTestServer(t, serverOptions, dialOptions...)
+
+	codec := grpc.CallContentSubtype(testJsonCodec{}.Name())
+	if err := conn.Invoke(context.Background(), "/test.Json/Unary", &jsonRequest{Name: "a"}, &jsonReply{}, codec); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Invoke(context.Background(), "/test.Json/Unary", &jsonRequest{Name: "fail"}, &jsonReply{}, codec)
+	stop()
+
+	var messages []map[string]any
+	for _, r := range capturedRecords(t, i, sink) {
+		if r["type"] == string(recordMessage) {
+			messages = append(messages, r)
+		}
+	}
+	if len(messages) != 4 {
+		t.Fatalf("got %d message records, want 4", len(messages))
+	}
+	if resp := messages[1]; resp["codec"] != "testjson" || resp["raw"] != base64.StdEncoding.EncodeToString([]byte(`{"message":"hello a"}`)) {
+		t.Errorf("got codec %v and raw %v", resp["codec"], resp["raw"])
+	}
+	// The typed nil response of the failed call is not captured as a payload.
+	if failed := messages[3]; failed["error"] == nil || failed["raw"] != nil || failed["message"] != nil {
+		t.Errorf("got failed response %v, want only the error", failed)
+	}
+}
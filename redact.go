@@ -0,0 +1,259 @@
+package grpc_json_sniffer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// RedactionMode decides how a sensitive value is written to the capture.
+type RedactionMode int
+
+const (
+	// RedactMask replaces the value with "[REDACTED]".
+	RedactMask RedactionMode = iota
+	// RedactRemove leaves the value out of the capture.
+	RedactRemove
+	// RedactHash replaces the value with a keyed hash, so that equal values can still be correlated
+	// without revealing them.
+	RedactHash
+)
+
+const redactedMask = "[REDACTED]"
+
+// redactor removes sensitive values from messages and metadata before they are captured.
+//
+// Fields are selected by their fully qualified name, such as "demo.HelloRequest.name",
+// or by the debug_redact field option in the proto definition.
+// Only string and bytes values can be masked or hashed, other values are always removed.
+// Messages packed in google.protobuf.Any are redacted as well, if their type can be resolved.
+type redactor struct {
+	fields   map[protoreflect.FullName]RedactionMode
+	metadata map[string]RedactionMode
+	key      []byte
+	resolver protoregistry.MessageTypeResolver // Resolves the types packed in google.protobuf.Any.
+
+	// Cache of message types that contain fields to redact, directly or in nested messages.
+	needsRedaction sync.Map // protoreflect.FullName -> bool
+}
+
+func newRedactor(fields map[string]RedactionMode, metadata map[string]RedactionMode, key []byte, resolver protoregistry.MessageTypeResolver) *redactor {
+	if resolver == nil {
+		resolver = protoregistry.GlobalTypes
+	}
+	if len(key) == 0 {
+		// Without a configured key the hashes can still be correlated within the lifetime of the process.
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
+	r := &redactor{
+		fields:   make(map[protoreflect.FullName]RedactionMode, len(fields)),
+		metadata: make(map[string]RedactionMode, len(metadata)),
+		key:      key,
+		resolver: resolver,
+	}
+	for name, mode := range fields {
+		r.fields[protoreflect.FullName(name)] = mode
+	}
+	for key, mode := range metadata {
+		r.metadata[strings.ToLower(key)] = mode
+	}
+	return r
+}
+
+// redactMessage returns the message with the sensitive fields redacted.
+// The original message is not modified, a copy is made if anything needs to be redacted.
+func (r *redactor) redactMessage(msg proto.Message) proto.Message {
+	if !r.messageNeedsRedaction(msg.ProtoReflect().Descriptor()) {
+		return msg
+	}
+	clone := proto.Clone(msg)
+	r.redact(clone.ProtoReflect())
+	return clone
+}
+
+// redactMetadata redacts the values of the sensitive metadata keys in place.
+func (r *redactor) redactMetadata(md map[string][]string) {
+	for key, values := range md {
+		mode, ok := r.metadata[key]
+		if !ok {
+			continue
+		}
+		if mode == RedactRemove {
+			delete(md, key)
+			continue
+		}
+		for n, v := range values {
+			values[n] = r.redactString(v, mode)
+		}
+	}
+}
+
+func (r *redactor) redact(m protoreflect.Message) {
+	if m.Descriptor().FullName() == anyFullName {
+		r.redactAny(m)
+		return
+	}
+
+	// Collect the fields first, the message must not be modified while iterating over it.
+	type field struct {
+		fd protoreflect.FieldDescriptor
+		v  protoreflect.Value
+	}
+	var fields []field
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fields = append(fields, field{fd, v})
+		return true
+	})
+
+	for _, f := range fields {
+		if mode, ok := r.fieldMode(f.fd); ok {
+			r.redactField(m, f.fd, f.v, mode)
+			continue
+		}
+		switch {
+		case f.fd.IsMap():
+			if f.fd.MapValue().Message() != nil {
+				f.v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					r.redact(v.Message())
+					return true
+				})
+			}
+		case f.fd.IsList():
+			if f.fd.Message() != nil {
+				list := f.v.List()
+				for n := 0; n < list.Len(); n++ {
+					r.redact(list.Get(n).Message())
+				}
+			}
+		case f.fd.Message() != nil:
+			r.redact(f.v.Message())
+		}
+	}
+}
+
+// redactAny redacts the message packed in the google.protobuf.Any and packs it again.
+// The Any is left as it is if the packed type cannot be resolved or has nothing to redact.
+func (r *redactor) redactAny(m protoreflect.Message) {
+	fields := m.Descriptor().Fields()
+	typeURL, value := fields.ByName("type_url"), fields.ByName("value")
+	if typeURL == nil || value == nil {
+		return
+	}
+	mt, err := r.resolver.FindMessageByURL(m.Get(typeURL).String())
+	if err != nil || !r.messageNeedsRedaction(mt.Descriptor()) {
+		return
+	}
+	inner := mt.New()
+	if err := proto.Unmarshal(m.Get(value).Bytes(), inner.Interface()); err != nil {
+		return
+	}
+	r.redact(inner)
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(inner.Interface())
+	if err != nil {
+		return
+	}
+	m.Set(value, protoreflect.ValueOfBytes(b))
+}
+
+func (r *redactor) redactField(m protoreflect.Message, fd protoreflect.FieldDescriptor, v protoreflect.Value, mode RedactionMode) {
+	valueFd := fd
+	if fd.IsMap() {
+		valueFd = fd.MapValue()
+	}
+	if mode == RedactRemove || (valueFd.Kind() != protoreflect.StringKind && valueFd.Kind() != protoreflect.BytesKind) {
+		m.Clear(fd)
+		return
+	}
+
+	switch {
+	case fd.IsMap():
+		fieldMap := v.Map()
+		var keys []protoreflect.MapKey
+		fieldMap.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+			keys = append(keys, k)
+			return true
+		})
+		for _, k := range keys {
+			fieldMap.Set(k, r.redactValue(fieldMap.Get(k), valueFd.Kind(), mode))
+		}
+	case fd.IsList():
+		list := v.List()
+		for n := 0; n < list.Len(); n++ {
+			list.Set(n, r.redactValue(list.Get(n), fd.Kind(), mode))
+		}
+	default:
+		m.Set(fd, r.redactValue(v, fd.Kind(), mode))
+	}
+}
+
+func (r *redactor) redactValue(v protoreflect.Value, kind protoreflect.Kind, mode RedactionMode) protoreflect.Value {
+	if kind == protoreflect.BytesKind {
+		return protoreflect.ValueOfBytes([]byte(r.redactString(string(v.Bytes()), mode)))
+	}
+	return protoreflect.ValueOfString(r.redactString(v.String(), mode))
+}
+
+func (r *redactor) redactString(s string, mode RedactionMode) string {
+	if mode == RedactHash {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(s))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return redactedMask
+}
+
+// fieldMode returns the redaction mode of the field, if the field is sensitive.
+// Explicitly configured fields take precedence over the debug_redact option.
+func (r *redactor) fieldMode(fd protoreflect.FieldDescriptor) (RedactionMode, bool) {
+	if mode, ok := r.fields[fd.FullName()]; ok {
+		return mode, true
+	}
+	if opts, ok := fd.Options().(*descriptorpb.FieldOptions); ok && opts.GetDebugRedact() {
+		return RedactMask, true
+	}
+	return 0, false
+}
+
+func (r *redactor) messageNeedsRedaction(md protoreflect.MessageDescriptor) bool {
+	if needs, ok := r.needsRedaction.Load(md.FullName()); ok {
+		return needs.(bool)
+	}
+	needs := r.containsRedactedFields(md, map[protoreflect.FullName]bool{})
+	r.needsRedaction.Store(md.FullName(), needs)
+	return needs
+}
+
+func (r *redactor) containsRedactedFields(md protoreflect.MessageDescriptor, visited map[protoreflect.FullName]bool) bool {
+	if visited[md.FullName()] {
+		return false
+	}
+	visited[md.FullName()] = true
+	// The type packed in an Any is known only from the message itself.
+	if md.FullName() == anyFullName {
+		return true
+	}
+
+	fields := md.Fields()
+	for n := 0; n < fields.Len(); n++ {
+		fd := fields.Get(n)
+		if _, ok := r.fieldMode(fd); ok {
+			return true
+		}
+		if fd.IsMap() {
+			fd = fd.MapValue()
+		}
+		if fd.Message() != nil && r.containsRedactedFields(fd.Message(), visited) {
+			return true
+		}
+	}
+	return false
+}
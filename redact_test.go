@@ -0,0 +1,97 @@
+package grpc_json_sniffer
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/tsaarni/grpc-json-sniffer/example/demo"
+)
+
+const secret = "secret-password"
+
+func mustAny(t *testing.T, msg proto.Message) *anypb.Any {
+	t.Helper()
+	a, err := anypb.New(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestRedactMessage(t *testing.T) {
+	r := newRedactor(map[string]RedactionMode{"demo.HelloRequest.name": RedactMask}, nil, nil, nil)
+	st, err := status.New(codes.InvalidArgument, "failed").WithDetails(&demo.HelloRequest{Name: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		msg  proto.Message
+	}{
+		{"message", &demo.HelloRequest{Name: secret}},
+		{"any", mustAny(t, &demo.HelloRequest{Name: secret})},
+		{"nested any", mustAny(t, mustAny(t, &demo.HelloRequest{Name: secret}))},
+		{"any in a field", st.Proto()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := proto.Clone(tt.msg)
+			redacted := r.redactMessage(tt.msg)
+
+			content, err := protojson.Marshal(redacted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(content), secret) {
+				t.Errorf("content contains the secret: %s", content)
+			}
+			if !strings.Contains(string(content), redactedMask) {
+				t.Errorf("content is not masked: %s", content)
+			}
+			raw, err := proto.Marshal(redacted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(raw), secret) {
+				t.Errorf("raw contains the secret: %q", raw)
+			}
+			if !proto.Equal(tt.msg, original) {
+				t.Error("original message was modified")
+			}
+		})
+	}
+}
+
+func TestRedactUnresolvedAny(t *testing.T) {
+	r := newRedactor(map[string]RedactionMode{"demo.HelloRequest.name": RedactMask}, nil, nil, nil)
+	a := &anypb.Any{TypeUrl: "type.googleapis.com/unknown.Type", Value: []byte{0x0a, 0x01, 'x'}}
+	if got := r.redactMessage(a); !proto.Equal(got, a) {
+		t.Errorf("unresolved Any was modified: %v", got)
+	}
+}
+
+func TestNewStatusRedactsDetails(t *testing.T) {
+	i := &GrpcJsonInterceptor{
+		redactor:      newRedactor(map[string]RedactionMode{"demo.HelloRequest.name": RedactMask}, nil, nil, nil),
+		typeCollector: newTypeCollector(nil),
+	}
+	st, err := status.New(codes.InvalidArgument, "failed").WithDetails(&demo.HelloRequest{Name: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := i.newStatus(st.Err())
+	if len(s.Details) != 1 {
+		t.Fatalf("got %d details, want 1", len(s.Details))
+	}
+	if detail := string(s.Details[0]); strings.Contains(detail, secret) || !strings.Contains(detail, redactedMask) {
+		t.Errorf("detail is not redacted: %s", detail)
+	}
+}
@@ -0,0 +1,139 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+const defaultRingRecords = 10000
+
+// RingSink keeps the last records in memory, discarding the oldest records when it is full.
+//
+// It allows capturing without a file, for example in containers with a read-only filesystem or in tests.
+// The web viewer serves the records straight from the ring, see WithMemoryBuffer.
+// The capture header and the descriptors of the message types are kept apart and never discarded,
+// so the records in the ring can always be decoded.
+type RingSink struct {
+	mu         sync.Mutex
+	maxRecords int
+	maxBytes   int
+	pinned     [][]byte // Capture header and descriptors records.
+	records    [][]byte
+	size       int           // Bytes in records.
+	first      uint64        // Sequence number of the first record in records.
+	changed    chan struct{} // Closed and replaced when a record is written.
+}
+
+// NewRingSink creates a new RingSink keeping at most maxRecords records and maxBytes bytes of records.
+//
+// Zero disables the corresponding limit. If both are zero, the last 10000 records are kept.
+// The newest record is always kept, even if it alone is larger than maxBytes.
+func NewRingSink(maxRecords, maxBytes int) *RingSink {
+	if maxRecords <= 0 && maxBytes <= 0 {
+		maxRecords = defaultRingRecords
+	}
+	return &RingSink{
+		maxRecords: maxRecords,
+		maxBytes:   maxBytes,
+		changed:    make(chan struct{}),
+	}
+}
+
+// Write stores a copy of the record, discarding the oldest records if the ring is full.
+func (s *RingSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, append([]byte(nil), record...))
+	s.size += len(record)
+	for len(s.records) > 1 && s.full() {
+		s.size -= len(s.records[0])
+		s.records[0] = nil
+		s.records = s.records[1:]
+		s.first++
+	}
+	s.notify()
+	return nil
+}
+
+func (s *RingSink) full() bool {
+	return (s.maxRecords > 0 && len(s.records) > s.maxRecords) || (s.maxBytes > 0 && s.size > s.maxBytes)
+}
+
+func (s *RingSink) writePinned(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pinned = append(s.pinned, append([]byte(nil), record...))
+	s.notify()
+	return nil
+}
+
+// notify wakes up the readers following the ring.
+func (s *RingSink) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Close does nothing, the records remain available after closing.
+func (s *RingSink) Close() error {
+	return nil
+}
+
+// Records returns the records in the ring, starting with the capture header and the descriptors of the message types.
+func (s *RingSink) Records() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(append([][]byte(nil), s.pinned...), s.records...)
+}
+
+// WriteTo writes the records in the ring to w, one JSON record per line.
+func (s *RingSink) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, record := range s.Records() {
+		if err := writeLine(w, record); err != nil {
+			return n, err
+		}
+		n += int64(len(record) + 1)
+	}
+	return n, nil
+}
+
+// follow sends the records in the ring to the channel, and then each new record as it is written,
+// until the context is done.
+// The synced function is called once, when the records already in the ring have been sent.
+// Records discarded before the reader gets to them are skipped.
+func (s *RingSink) follow(ctx context.Context, lines chan<- string, synced func()) {
+	pinned := 0
+	var next uint64
+	for {
+		s.mu.Lock()
+		newPinned := s.pinned[pinned:]
+		pinned = len(s.pinned)
+		next = max(next, s.first)
+		// Copied, since the oldest records are cleared from the slice when they are discarded.
+		newRecords := append([][]byte(nil), s.records[next-s.first:]...)
+		next = s.first + uint64(len(s.records))
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, records := range [][][]byte{newPinned, newRecords} {
+			for _, record := range records {
+				select {
+				case lines <- string(record) + "\n":
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		if synced != nil {
+			synced()
+			synced = nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
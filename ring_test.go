@@ -0,0 +1,158 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ringRecords(s *RingSink) []string {
+	var records []string
+	for _, r := range s.Records() {
+		records = append(records, string(r))
+	}
+	return records
+}
+
+func TestRingSinkEviction(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRecords int
+		maxBytes   int
+		write      []string
+		want       []string
+	}{
+		{
+			name:       "max records",
+			maxRecords: 2,
+			write:      []string{"r1", "r2", "r3"},
+			want:       []string{"header", "r2", "r3"},
+		},
+		{
+			name:     "max bytes",
+			maxBytes: 5,
+			write:    []string{"r1", "r2", "r3"},
+			want:     []string{"header", "r2", "r3"},
+		},
+		{
+			name:     "newest record larger than max bytes",
+			maxBytes: 5,
+			write:    []string{"r1", "large record"},
+			want:     []string{"header", "large record"},
+		},
+		{
+			name:  "default",
+			write: []string{"r1", "r2"},
+			want:  []string{"header", "r1", "r2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewRingSink(tt.maxRecords, tt.maxBytes)
+			// The pinned header does not count against the limits.
+			if err := s.writePinned([]byte("header")); err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tt.write {
+				if err := s.Write([]byte(r)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := ringRecords(s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingSinkPinnedNeverDiscarded(t *testing.T) {
+	s := NewRingSink(1, 0)
+	record := []byte("r1")
+	_ = s.writePinned([]byte("header"))
+	_ = s.Write(record)
+	_ = s.writePinned([]byte("descriptors"))
+	_ = s.Write([]byte("r2"))
+	_ = s.Write([]byte("r3"))
+
+	// The ring keeps a copy of the record.
+	record[0] = 'x'
+	if got, want := ringRecords(s), []string{"header", "descriptors", "r3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.Records()); got != 3 {
+		t.Errorf("got %d records after close, want 3", got)
+	}
+}
+
+func receive(t *testing.T, lines <-chan string, n int) []string {
+	t.Helper()
+	var got []string
+	for range n {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after receiving %q", got)
+		}
+	}
+	return got
+}
+
+func TestRingSinkFollow(t *testing.T) {
+	s := NewRingSink(3, 0)
+	_ = s.writePinned([]byte("header"))
+	for _, r := range []string{"r1", "r2"} {
+		_ = s.Write([]byte(r))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lines := make(chan string)
+	syncedCalls := make(chan struct{}, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.follow(ctx, lines, func() { syncedCalls <- struct{}{} })
+	}()
+
+	// The existing records are sent first, pinned records before the others.
+	if got, want := receive(t, lines, 1), []string{"header\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The follower is behind: the records it has not read yet are discarded, but the new pinned record is not.
+	for _, r := range []string{"r3", "r4", "r5", "r6", "r7"} {
+		_ = s.Write([]byte(r))
+	}
+	_ = s.writePinned([]byte("descriptors"))
+	if got, want := receive(t, lines, 2), []string{"r1\n", "r2\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	select {
+	case <-syncedCalls:
+	case <-time.After(time.Second):
+		t.Fatal("synced was not called")
+	}
+	if got, want := receive(t, lines, 4), []string{"descriptors\n", "r5\n", "r6\n", "r7\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// New records are sent as they are written.
+	_ = s.Write([]byte("r8"))
+	if got, want := receive(t, lines, 1), []string{"r8\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(syncedCalls) != 0 {
+		t.Error("synced was called more than once")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("follow did not return when cancelled")
+	}
+}
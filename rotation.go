@@ -0,0 +1,219 @@
+package grpc_json_sniffer
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rotation configures the rotation of the capture file.
+//
+// When the file is rotated, it is renamed with the time of rotation added to its name, for example
+// "capture.json" becomes "capture-20250102T150405.000000000Z.json", and a new empty file is opened
+// under the original name.
+type Rotation struct {
+	// MaxSize rotates the file before it grows beyond the given number of bytes.
+	// Zero disables size-based rotation.
+	MaxSize int64
+	// Interval rotates the file when it has been written for longer than the given duration.
+	// The rotation happens on the first write after the interval has elapsed.
+	// Zero disables time-based rotation.
+	Interval time.Duration
+	// MaxFiles is the number of rotated files kept. Older files are removed.
+	// Zero keeps all files.
+	MaxFiles int
+	// MaxAge removes rotated files older than the given duration.
+	// Zero keeps all files.
+	MaxAge time.Duration
+	// Compress compresses the rotated files with gzip, adding ".gz" to their name.
+	Compress bool
+}
+
+func (r Rotation) enabled() bool {
+	return r.MaxSize > 0 || r.Interval > 0
+}
+
+const rotationTimeFormat = "20060102T150405.000000000Z"
+
+// NewRotatingFileSink creates a new FileSink that rotates the file according to the rotation configuration.
+//
+// If the file already exists and rotation is enabled, the existing file is rotated instead of truncated,
+// so that the records from the previous run are kept.
+func NewRotatingFileSink(filename string, rotation Rotation) (*FileSink, error) {
+	s := &FileSink{
+		filename: filename,
+		rotation: rotation,
+	}
+
+	if rotation.enabled() {
+		if info, err := os.Stat(filename); err == nil && info.Size() > 0 {
+			if err := s.rotateExisting(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rotate moves the current file aside, and continues writing to a new empty file.
+// It can be used to start a fresh capture, even if rotation is not otherwise enabled.
+// If the rotation fails, the capture continues in the current file.
+func (s *FileSink) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate()
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.size = 0
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *FileSink) needsRotation(size int) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.rotation.MaxSize > 0 && s.size+int64(size) > s.rotation.MaxSize {
+		return true
+	}
+	return s.rotation.Interval > 0 && time.Since(s.opened) > s.rotation.Interval
+}
+
+// rotate must be called with s.mu held.
+//
+// The file is renamed before a new file is opened, and closed only after that.
+// If the rotation fails, the records continue to be written to the current file under its original name.
+func (s *FileSink) rotate() error {
+	current := s.file
+	rotated := s.rotatedName(time.Now())
+	if err := os.Rename(s.filename, rotated); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		_ = os.Rename(rotated, s.filename)
+		return err
+	}
+	// The file is not buffered, so all the records have already been written.
+	_ = current.Close()
+	s.cleanup(rotated)
+
+	// The header is written with the next record, from the goroutine that owns its contents.
+	s.headerPending = s.header != nil
+	return nil
+}
+
+// rotateExisting renames the file left by a previous run and cleans up the rotated files.
+func (s *FileSink) rotateExisting() error {
+	rotated := s.rotatedName(time.Now())
+	if err := os.Rename(s.filename, rotated); err != nil {
+		return err
+	}
+	s.cleanup(rotated)
+	return nil
+}
+
+// cleanup starts compressing the rotated file and removing the old rotated files in the background.
+func (s *FileSink) cleanup(rotated string) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.cleanupMu.Lock()
+		defer s.cleanupMu.Unlock()
+		if s.rotation.Compress {
+			_ = compressFile(rotated)
+		}
+		s.removeOldFiles()
+	}()
+}
+
+// rotatedName returns the name of the rotated file, with the time of rotation before the extension.
+func (s *FileSink) rotatedName(t time.Time) string {
+	ext := filepath.Ext(s.filename)
+	base := strings.TrimSuffix(s.filename, ext)
+	return base + "-" + t.UTC().Format(rotationTimeFormat) + ext
+}
+
+// removeOldFiles removes the rotated files exceeding MaxFiles or MaxAge.
+func (s *FileSink) removeOldFiles() {
+	if s.rotation.MaxFiles <= 0 && s.rotation.MaxAge <= 0 {
+		return
+	}
+
+	dir := filepath.Dir(s.filename)
+	ext := filepath.Ext(s.filename)
+	prefix := strings.TrimSuffix(filepath.Base(s.filename), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	// The timestamp in the name sorts the files from the oldest to the newest.
+	var rotated []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+		if _, err := time.Parse(rotationTimeFormat, stamp); err == nil {
+			rotated = append(rotated, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(rotated)
+
+	for n, name := range rotated {
+		tooMany := s.rotation.MaxFiles > 0 && n < len(rotated)-s.rotation.MaxFiles
+		tooOld := false
+		if s.rotation.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil {
+				tooOld = time.Since(info.ModTime()) > s.rotation.MaxAge
+			}
+		}
+		if tooMany || tooOld {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// compressFile compresses the file with gzip and removes the original.
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //nolint:errcheck
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,64 @@
+package grpc_json_sniffer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "capture.json")
+	s, err := NewRotatingFileSink(filename, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() //nolint:errcheck
+
+	if err := s.Write([]byte(`"first"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotation cannot rename a file that is no longer at its path.
+	moved := filepath.Join(dir, "moved.json")
+	if err := os.Rename(filename, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rotate(); err == nil {
+		t.Fatal("Rotate succeeded without the file")
+	}
+	if err := s.Write([]byte(`"second"`)); err != nil {
+		t.Fatalf("Write failed after a failed rotation: %v", err)
+	}
+	if got, want := readFile(t, moved), "\"first\"\n\"second\"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Once the file is back, the next write rotates it.
+	if err := os.Rename(moved, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write([]byte(`"third"`)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, filename), "\"third\"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "capture-*.json"))
+	if len(rotated) != 1 {
+		t.Fatalf("got rotated files %v, want one", rotated)
+	}
+	if got := readFile(t, rotated[0]); !strings.HasSuffix(got, "\"second\"\n") {
+		t.Errorf("rotated file %q does not end with the second record", got)
+	}
+}
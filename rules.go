@@ -0,0 +1,239 @@
+package grpc_json_sniffer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CaptureRule selects which calls and messages are captured.
+//
+// Rules are evaluated in order and the first rule that matches a record decides what happens to it.
+// Records that do not match any rule are captured.
+type CaptureRule struct {
+	// Exclude drops the matching records instead of capturing them.
+	Exclude bool
+	// Method is a glob pattern matched against the full method name, for example "/grpc.health.v1.Health/*".
+	// The wildcard "*" matches any sequence of characters, including "/", and "?" matches a single character.
+	// An empty pattern matches all methods.
+	Method string
+	// Peer is a glob pattern matched against the address of the remote peer.
+	// For clients, the peer is the target of the connection.
+	// An empty pattern matches all peers.
+	Peer string
+	// Direction limits the rule to messages sent ("send") or received ("recv").
+	// Rules with a direction match only message records, not headers or call lifecycle records.
+	Direction string
+	// SampleRate is the fraction of calls captured, between 0 and 1.
+	// Sampling is decided once per call, so a call is either captured whole or not at all.
+	// Zero captures all calls.
+	SampleRate float64
+	// First limits the capture to the first N messages of each call.
+	First int
+	// Last limits the capture to the last N messages of each call.
+	// The messages are held in memory until the call ends.
+	// When both First and Last are zero, all messages are captured.
+	Last int
+}
+
+// ParseCaptureRules parses capture rules from a string.
+//
+// Rules are separated by semicolons. Each rule starts with "include" or "exclude",
+// followed by space separated key=value pairs: method, peer, direction, sample, first and last.
+//
+// Example:
+//
+//	exclude method=/grpc.health.v1.Health/*; include method=/demo.Demo/* sample=0.1 first=10 last=10
+func ParseCaptureRules(s string) ([]CaptureRule, error) {
+	var rules []CaptureRule
+	for _, text := range strings.Split(s, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var rule CaptureRule
+		switch fields[0] {
+		case "include":
+		case "exclude":
+			rule.Exclude = true
+		default:
+			return nil, fmt.Errorf("invalid capture rule %q: must start with include or exclude", text)
+		}
+
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid capture rule %q: expected key=value, got %q", text, field)
+			}
+			var err error
+			switch key {
+			case "method":
+				rule.Method = value
+			case "peer":
+				rule.Peer = value
+			case "direction":
+				if value != string(directionSend) && value != string(directionReceive) {
+					return nil, fmt.Errorf("invalid capture rule %q: direction must be send or recv", text)
+				}
+				rule.Direction = value
+			case "sample":
+				rule.SampleRate, err = strconv.ParseFloat(value, 64)
+				if err == nil && (rule.SampleRate < 0 || rule.SampleRate > 1) {
+					err = fmt.Errorf("must be between 0 and 1")
+				}
+			case "first":
+				rule.First, err = parseCount(value)
+			case "last":
+				rule.Last, err = parseCount(value)
+			default:
+				return nil, fmt.Errorf("invalid capture rule %q: unknown key %q", text, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid capture rule %q: invalid %s: %w", text, key, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseCount parses a non-negative number of messages.
+func parseCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return n, err
+}
+
+// String formats the rule in the syntax accepted by ParseCaptureRules.
+func (r CaptureRule) String() string {
+	parts := []string{"include"}
+	if r.Exclude {
+		parts[0] = "exclude"
+	}
+	if r.Method != "" {
+		parts = append(parts, "method="+r.Method)
+	}
+	if r.Peer != "" {
+		parts = append(parts, "peer="+r.Peer)
+	}
+	if r.Direction != "" {
+		parts = append(parts, "direction="+r.Direction)
+	}
+	if r.SampleRate != 0 {
+		parts = append(parts, "sample="+strconv.FormatFloat(r.SampleRate, 'g', -1, 64))
+	}
+	if r.First != 0 {
+		parts = append(parts, "first="+strconv.Itoa(r.First))
+	}
+	if r.Last != 0 {
+		parts = append(parts, "last="+strconv.Itoa(r.Last))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (r *CaptureRule) matches(method, peer string, direction direction, message bool) bool {
+	if r.Direction != "" && (!message || r.Direction != string(direction)) {
+		return false
+	}
+	return globMatch(r.Method, method) && globMatch(r.Peer, peer)
+}
+
+// captureDecision tells what to do with a record.
+type captureDecision int
+
+const (
+	captureWrite captureDecision = iota // Write the record.
+	captureDrop                         // Drop the record.
+	captureDefer                        // Hold the record until the call ends, it may be one of the last N messages.
+)
+
+// ruleSet evaluates the capture rules.
+type ruleSet struct {
+	rules []CaptureRule
+}
+
+func newRuleSet(rules []CaptureRule) *ruleSet {
+	return &ruleSet{rules: rules}
+}
+
+// excludesCall returns true if all records of the call are dropped,
+// so that the call does not need to be intercepted at all.
+func (rs *ruleSet) excludesCall(method, peer string) bool {
+	for n := range rs.rules {
+		r := &rs.rules[n]
+		if !globMatch(r.Method, method) || !globMatch(r.Peer, peer) {
+			continue
+		}
+		// A rule with a direction could include some messages of the call.
+		return r.Exclude && r.Direction == ""
+	}
+	return false
+}
+
+// decide returns what to do with a record of the call.
+// The caller must hold c.mu when deciding on message records.
+func (rs *ruleSet) decide(c *call, message bool, direction direction) captureDecision {
+	var rule *CaptureRule
+	for n := range rs.rules {
+		if rs.rules[n].matches(c.method, c.matchPeer, direction, message) {
+			rule = &rs.rules[n]
+			break
+		}
+	}
+	if rule == nil {
+		return captureWrite
+	}
+	if rule.Exclude {
+		return captureDrop
+	}
+	if rule.SampleRate > 0 && c.sample >= rule.SampleRate {
+		return captureDrop
+	}
+	if !message || (rule.First == 0 && rule.Last == 0) {
+		return captureWrite
+	}
+
+	c.limited++
+	if c.limited <= rule.First {
+		return captureWrite
+	}
+	if rule.Last > 0 {
+		c.tailSize = rule.Last
+		return captureDefer
+	}
+	return captureDrop
+}
+
+// globMatch matches s against a pattern where "*" matches any sequence of characters and "?" matches
+// a single character. An empty pattern matches everything.
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	// Position to return to when a mismatch happens after a "*".
+	starPattern, starS := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			starPattern, starS = p, i
+			p++
+		case starPattern >= 0:
+			// Let the last "*" consume one more character.
+			starS++
+			p, i = starPattern+1, starS
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
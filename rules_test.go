@@ -0,0 +1,248 @@
+package grpc_json_sniffer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "/demo.Demo/Hello", true},
+		{"/demo.Demo/Hello", "/demo.Demo/Hello", true},
+		{"/demo.Demo/Hello", "/demo.Demo/Hell", false},
+		{"/demo.Demo/Hell", "/demo.Demo/Hello", false},
+		{"/demo.Demo/*", "/demo.Demo/Hello", true},
+		{"/demo.Demo/*", "/demo.Demo/", true},
+		{"*", "", true},
+		{"?", "", false},
+		{"*Hello", "/demo.Demo/Hello", true},
+		{"/grpc.health.v1.Health/*", "/demo.Demo/Hello", false},
+		{"*/Hello", "/a/b/Hello", true}, // "*" matches "/" as well.
+		{"/demo.Demo/Hell?", "/demo.Demo/Hello", true},
+		{"/demo.Demo/Hell?", "/demo.Demo/Hell", false},
+		{"**", "abc", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		// A mismatch after a "*" backtracks and lets the "*" consume more.
+		{"a*abc", "aababc", true},
+		{"*ab*ab", "xabyabab", true},
+		{"*a*b", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+		{"10.0.0.*:*", "10.0.0.7:443", true},
+		{"10.0.0.*:*", "10.0.1.7:443", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseCaptureRules(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []CaptureRule
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{input: " ; ;", want: nil},
+		{
+			input: "exclude method=/grpc.health.v1.Health/*; include method=/demo.Demo/* sample=0.1 first=10 last=5",
+			want: []CaptureRule{
+				{Exclude: true, Method: "/grpc.health.v1.Health/*"},
+				{Method: "/demo.Demo/*", SampleRate: 0.1, First: 10, Last: 5},
+			},
+		},
+		{
+			input: "include peer=10.0.0.*:* direction=recv",
+			want:  []CaptureRule{{Peer: "10.0.0.*:*", Direction: "recv"}},
+		},
+		{input: "capture method=/a/b", wantErr: true},
+		{input: "include method", wantErr: true},
+		{input: "include color=red", wantErr: true},
+		{input: "include direction=both", wantErr: true},
+		{input: "include sample=1.5", wantErr: true},
+		{input: "include sample=-0.1", wantErr: true},
+		{input: "include sample=half", wantErr: true},
+		{input: "include first=ten", wantErr: true},
+		{input: "include first=-1", wantErr: true},
+		{input: "include last=-1", wantErr: true},
+		{input: "include method=/a/b; exclude bogus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCaptureRules(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCaptureRules(%q) error = %v, want error %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCaptureRules(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestCaptureRuleStringRoundTrip(t *testing.T) {
+	rules := []CaptureRule{
+		{},
+		{Exclude: true, Method: "/grpc.health.v1.Health/*"},
+		{Method: "/demo.Demo/*", Peer: "10.0.0.*:*", Direction: "send", SampleRate: 0.25, First: 3, Last: 2},
+	}
+	for _, rule := range rules {
+		parsed, err := ParseCaptureRules(rule.String())
+		if err != nil {
+			t.Fatalf("ParseCaptureRules(%q): %v", rule.String(), err)
+		}
+		if len(parsed) != 1 || parsed[0] != rule {
+			t.Errorf("ParseCaptureRules(%q) = %+v, want %+v", rule.String(), parsed, rule)
+		}
+	}
+}
+
+func TestRuleSetDecide(t *testing.T) {
+	const (
+		w = captureWrite
+		d = captureDrop
+		h = captureDefer
+	)
+	// message is a message record, other are headers and call lifecycle records.
+	type record struct {
+		message   bool
+		direction direction
+	}
+	send := record{true, directionSend}
+	recv := record{true, directionReceive}
+	other := record{false, directionSend}
+
+	tests := []struct {
+		name    string
+		rules   string
+		method  string
+		sample  float64
+		records []record
+		want    []captureDecision
+	}{
+		{
+			name:    "no rules",
+			method:  "/demo.Demo/Hello",
+			records: []record{other, send, recv},
+			want:    []captureDecision{w, w, w},
+		},
+		{
+			name:    "exclude method",
+			rules:   "exclude method=/demo.Demo/*",
+			method:  "/demo.Demo/Hello",
+			records: []record{other, send, recv},
+			want:    []captureDecision{d, d, d},
+		},
+		{
+			name:    "other method",
+			rules:   "exclude method=/grpc.health.v1.Health/*",
+			method:  "/demo.Demo/Hello",
+			records: []record{other, send},
+			want:    []captureDecision{w, w},
+		},
+		{
+			name:    "first rule decides",
+			rules:   "include method=/demo.Demo/Hello; exclude method=/demo.Demo/*",
+			method:  "/demo.Demo/Hello",
+			records: []record{send},
+			want:    []captureDecision{w},
+		},
+		{
+			name:    "direction matches only messages",
+			rules:   "exclude direction=recv",
+			method:  "/demo.Demo/Hello",
+			records: []record{other, send, recv},
+			want:    []captureDecision{w, w, d},
+		},
+		{
+			name:    "sampled in",
+			rules:   "include sample=0.5",
+			method:  "/demo.Demo/Hello",
+			sample:  0.49,
+			records: []record{other, send},
+			want:    []captureDecision{w, w},
+		},
+		{
+			name:    "sampled out",
+			rules:   "include sample=0.5",
+			method:  "/demo.Demo/Hello",
+			sample:  0.5,
+			records: []record{other, send},
+			want:    []captureDecision{d, d},
+		},
+		{
+			name:    "first",
+			rules:   "include first=2",
+			method:  "/demo.Demo/Hello",
+			records: []record{send, other, recv, send, other},
+			want:    []captureDecision{w, w, w, d, w},
+		},
+		{
+			name:    "last",
+			rules:   "include last=2",
+			method:  "/demo.Demo/Hello",
+			records: []record{send, other, recv},
+			want:    []captureDecision{h, w, h},
+		},
+		{
+			name:    "first and last",
+			rules:   "include first=1 last=2",
+			method:  "/demo.Demo/Hello",
+			records: []record{send, recv, send, recv},
+			want:    []captureDecision{w, h, h, h},
+		},
+		{
+			name:    "first and last with a direction",
+			rules:   "include direction=recv first=1 last=1",
+			method:  "/demo.Demo/Hello",
+			records: []record{recv, send, recv, recv},
+			want:    []captureDecision{w, w, h, h},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseCaptureRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs := newRuleSet(rules)
+			c := &call{method: tt.method, matchPeer: "10.0.0.1:443", sample: tt.sample}
+			var got []captureDecision
+			for _, r := range tt.records {
+				got = append(got, rs.decide(c, r.message, r.direction))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetExcludesCall(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  bool
+	}{
+		{"", false},
+		{"exclude method=/demo.Demo/*", true},
+		{"exclude peer=10.0.0.*", true},
+		{"exclude peer=192.168.*", false},
+		{"include method=/demo.Demo/Hello; exclude method=/demo.Demo/*", false},
+		{"exclude method=/demo.Demo/* direction=recv", false},
+		{"include sample=0.1; exclude method=/demo.Demo/*", false},
+	}
+	for _, tt := range tests {
+		rules, err := ParseCaptureRules(tt.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := newRuleSet(rules).excludesCall("/demo.Demo/Hello", "10.0.0.1:443"); got != tt.want {
+			t.Errorf("excludesCall with %q = %v, want %v", tt.rules, got, tt.want)
+		}
+	}
+}
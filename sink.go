@@ -0,0 +1,250 @@
+package grpc_json_sniffer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink receives the records captured by GrpcJsonInterceptor.
+//
+// Each call to Write passes one complete record encoded as a single line of JSON, without the trailing newline.
+// The sink must not retain the slice after Write returns.
+// GrpcJsonInterceptor calls Write from a single background goroutine, in message ID order.
+// Close is called from the same goroutine, after the last record has been written.
+// Sinks that buffer records can implement Flush() error, which is called by GrpcJsonInterceptor.Flush.
+type Sink interface {
+	Write(record []byte) error
+	Close() error
+}
+
+// flusher is implemented by sinks that buffer records.
+// Flush is called by GrpcJsonInterceptor.Flush, possibly concurrently with Write.
+type flusher interface {
+	Flush() error
+}
+
+// headerSink is implemented by sinks that split the capture into several files.
+// Each file starts with the capture header, so that it can be read on its own.
+type headerSink interface {
+	// setHeader sets the function returning the header record.
+	// It is called from the goroutine writing the records, before writing to a new file.
+	setHeader(header func() ([]byte, error))
+}
+
+// pinningSink is implemented by sinks that discard old records.
+// The capture header and the descriptors records are written with writePinned, so that they can be kept
+// for as long as the records that need them.
+type pinningSink interface {
+	writePinned(record []byte) error
+}
+
+// FileSink writes records to a file, one JSON record per line.
+// The file can be rotated by size and age, see NewRotatingFileSink.
+type FileSink struct {
+	mu       sync.Mutex
+	file     *os.File
+	filename string
+	rotation Rotation
+	size     int64     // Bytes written to the current file.
+	opened   time.Time // Time when the current file was opened.
+
+	header        func() ([]byte, error) // Returns the capture header, written at the start of rotated files.
+	headerPending bool                   // The current file was opened by rotation and does not have the header yet.
+
+	// Compression and removal of rotated files runs in the background, one rotation at a time.
+	background sync.WaitGroup
+	cleanupMu  sync.Mutex
+}
+
+// NewFileSink creates a new FileSink writing to the given file.
+// The file is created if it does not exist and truncated if it does.
+func NewFileSink(filename string) (*FileSink, error) {
+	return NewRotatingFileSink(filename, Rotation{})
+}
+
+// Write appends the record and a newline to the file.
+// The file is rotated first, if the record would not fit in it or the file is too old.
+func (s *FileSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.needsRotation(len(record) + 1) {
+		// If the rotation fails, the record is written to the current file, and the rotation is retried with the next record.
+		_ = s.rotate()
+	}
+	if s.headerPending {
+		s.headerPending = false
+		if header, err := s.header(); err == nil {
+			if err := s.writeRecord(header); err != nil {
+				return err
+			}
+		}
+	}
+	return s.writeRecord(record)
+}
+
+func (s *FileSink) writeRecord(record []byte) error {
+	if err := writeLine(s.file, record); err != nil {
+		return err
+	}
+	s.size += int64(len(record) + 1)
+	return nil
+}
+
+func (s *FileSink) setHeader(header func() ([]byte, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = header
+}
+
+// Close closes the file.
+// It waits for the compression of rotated files to complete.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.file.Close()
+	s.background.Wait()
+	return err
+}
+
+// WriterSink writes records to an io.Writer, one JSON record per line.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink creates a new WriterSink writing to w.
+// The writer is not closed when the sink is closed.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write appends the record and a newline to the writer.
+func (s *WriterSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeLine(s.w, record)
+}
+
+// Close does nothing, the underlying writer is owned by the caller.
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// MemorySink keeps all records in memory.
+// It is mainly useful in tests.
+type MemorySink struct {
+	mu      sync.Mutex
+	records [][]byte
+}
+
+// NewMemorySink creates a new empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Write stores a copy of the record.
+func (s *MemorySink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, append([]byte(nil), record...))
+	return nil
+}
+
+// Close does nothing, the records remain available after closing.
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// Records returns the records written so far.
+func (s *MemorySink) Records() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.records...)
+}
+
+// Reset discards all stored records.
+func (s *MemorySink) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = nil
+}
+
+// MultiSink writes each record to several sinks.
+type MultiSink struct {
+	sinks []Sink
+}
+
+// NewMultiSink creates a new MultiSink that fans out records to all given sinks.
+func NewMultiSink(sinks ...Sink) *MultiSink {
+	return &MultiSink{sinks: append([]Sink(nil), sinks...)}
+}
+
+// Write writes the record to every sink.
+// A failing sink does not prevent the record from being written to the others.
+func (s *MultiSink) Write(record []byte) error {
+	var errs []error
+	for _, sink := range s.sinks {
+		if err := sink.Write(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MultiSink) writePinned(record []byte) error {
+	var errs []error
+	for _, sink := range s.sinks {
+		write := sink.Write
+		if ps, ok := sink.(pinningSink); ok {
+			write = ps.writePinned
+		}
+		if err := write(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *MultiSink) setHeader(header func() ([]byte, error)) {
+	for _, sink := range s.sinks {
+		if hs, ok := sink.(headerSink); ok {
+			hs.setHeader(header)
+		}
+	}
+}
+
+// Flush flushes every sink that buffers records.
+func (s *MultiSink) Flush() error {
+	var errs []error
+	for _, sink := range s.sinks {
+		if f, ok := sink.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink.
+func (s *MultiSink) Close() error {
+	var errs []error
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeLine writes the record followed by a newline with a single call to Write.
+func writeLine(w io.Writer, record []byte) error {
+	line := make([]byte, 0, len(record)+1)
+	line = append(line, record...)
+	line = append(line, '\n')
+	_, err := w.Write(line)
+	return err
+}
@@ -0,0 +1,180 @@
+package grpc_json_sniffer
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testSink records the calls made to it and fails them with the given errors.
+type testSink struct {
+	MemorySink
+	writeErr, flushErr, closeErr error
+	header                       func() ([]byte, error)
+	flushes, closes              int
+}
+
+func (s *testSink) Write(record []byte) error {
+	_ = s.MemorySink.Write(record)
+	return s.writeErr
+}
+
+func (s *testSink) Flush() error {
+	s.flushes++
+	return s.flushErr
+}
+
+func (s *testSink) Close() error {
+	s.closes++
+	return s.closeErr
+}
+
+func (s *testSink) setHeader(header func() ([]byte, error)) {
+	s.header = header
+}
+
+func recordStrings(records [][]byte) []string {
+	var s []string
+	for _, r := range records {
+		s = append(s, string(r))
+	}
+	return s
+}
+
+func TestMultiSink(t *testing.T) {
+	errWrite1, errWrite2 := errors.New("write 1"), errors.New("write 2")
+	errFlush, errClose := errors.New("flush"), errors.New("close")
+	failing1 := &testSink{writeErr: errWrite1, flushErr: errFlush, closeErr: errClose}
+	failing2 := &testSink{writeErr: errWrite2}
+	memory := NewMemorySink()
+	ring := NewRingSink(1, 0)
+	sinks := []Sink{failing1, memory, ring, failing2}
+	s := NewMultiSink(sinks...)
+	// The sinks given to the constructor are copied.
+	sinks[1] = failing2
+
+	// Each record goes to every sink, and the errors of all failing sinks are returned.
+	_ = s.writePinned([]byte("header"))
+	for _, r := range []string{"r1", "r2"} {
+		err := s.Write([]byte(r))
+		if !errors.Is(err, errWrite1) || !errors.Is(err, errWrite2) {
+			t.Errorf("got error %v, want both write errors", err)
+		}
+	}
+	want := []string{"header", "r1", "r2"}
+	for _, sink := range []*MemorySink{&failing1.MemorySink, memory, &failing2.MemorySink} {
+		if got := recordStrings(sink.Records()); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// The ring keeps the pinned header although it holds a single record.
+	if got, want := recordStrings(ring.Records()), []string{"header", "r2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got ring records %q, want %q", got, want)
+	}
+
+	s.setHeader(func() ([]byte, error) { return []byte("header"), nil })
+	if failing1.header == nil || failing2.header == nil {
+		t.Error("header was not set on every sink splitting the capture")
+	}
+
+	// Only the sinks that buffer records are flushed.
+	if err := s.Flush(); !errors.Is(err, errFlush) {
+		t.Errorf("got flush error %v, want %v", err, errFlush)
+	}
+	if failing1.flushes != 1 || failing2.flushes != 1 {
+		t.Errorf("got %d and %d flushes, want 1", failing1.flushes, failing2.flushes)
+	}
+
+	// Every sink is closed, even after one has failed.
+	if err := s.Close(); !errors.Is(err, errClose) {
+		t.Errorf("got close error %v, want %v", err, errClose)
+	}
+	if failing1.closes != 1 || failing2.closes != 1 {
+		t.Errorf("got %d and %d closes, want 1", failing1.closes, failing2.closes)
+	}
+	if err := NewMultiSink(memory, ring).Close(); err != nil {
+		t.Errorf("got close error %v, want nil", err)
+	}
+}
+
+// countingWriter counts the calls to Write and Close.
+type countingWriter struct {
+	bytes.Buffer
+	writes, closes int
+	err            error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *countingWriter) Close() error {
+	w.closes++
+	return nil
+}
+
+func TestWriterSink(t *testing.T) {
+	w := &countingWriter{}
+	s := NewWriterSink(w)
+	for _, r := range []string{`{"message_id":1}`, `{"message_id":2}`} {
+		if err := s.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := w.String(), "{\"message_id\":1}\n{\"message_id\":2}\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Each line is written at once, so that records from several sinks sharing a writer are not interleaved.
+	if w.writes != 2 {
+		t.Errorf("got %d writes, want 2", w.writes)
+	}
+
+	w.err = errors.New("disk full")
+	if err := s.Write([]byte("r")); !errors.Is(err, w.err) {
+		t.Errorf("got error %v, want %v", err, w.err)
+	}
+
+	// The writer belongs to the caller.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.closes != 0 {
+		t.Error("writer was closed by the sink")
+	}
+}
+
+func TestMemorySink(t *testing.T) {
+	s := NewMemorySink()
+	record := []byte("r1")
+	_ = s.Write(record)
+	// The sink must not retain the slice given to Write.
+	record[0] = 'x'
+	_ = s.Write([]byte("r2"))
+
+	records := s.Records()
+	if got, want := recordStrings(records), []string{"r1", "r2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// The returned slice is a copy.
+	records[0] = []byte("changed")
+	if got := string(s.Records()[0]); got != "r1" {
+		t.Errorf("got %q after changing the returned records, want %q", got, "r1")
+	}
+
+	// The records remain after closing, until they are reset.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.Records()); got != 2 {
+		t.Errorf("got %d records after close, want 2", got)
+	}
+	s.Reset()
+	if got := s.Records(); len(got) != 0 {
+		t.Errorf("got %q after reset, want none", recordStrings(got))
+	}
+}
@@ -0,0 +1,229 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// StatsHandler captures gRPC calls as a stats.Handler, producing the same records as the interceptors.
+//
+// Unlike the interceptors, the stats handler sees the transport: the uncompressed, compressed and wire
+// sizes of the messages and headers, the compression algorithm, the times when the messages were sent
+// and received, and each attempt of a retried client call.
+// Use the stats handler instead of the interceptors, not together with them, or each call is captured twice.
+type StatsHandler struct {
+	interceptor *GrpcJsonInterceptor
+	side        side
+
+	// Attempts of the client calls in progress, by the done channel of the call context shared by the attempts.
+	attempts sync.Map // <-chan struct{} -> *clientCall
+}
+
+// clientCall is the state shared by the attempts of a client call.
+type clientCall struct {
+	mu       sync.Mutex
+	id       int64
+	sample   float64
+	attempts int
+}
+
+// statsCall is the state of a call captured by the stats handler.
+type statsCall struct {
+	*call
+	inHeader *stats.InHeader // Request headers received by the server before the call begins.
+}
+
+type statsCallKey struct{}
+
+// ServerStatsHandler returns a stats handler that captures the calls of a gRPC server.
+func (i *GrpcJsonInterceptor) ServerStatsHandler() *StatsHandler {
+	return &StatsHandler{interceptor: i, side: sideServer}
+}
+
+// ClientStatsHandler returns a stats handler that captures the calls of a gRPC client.
+func (i *GrpcJsonInterceptor) ClientStatsHandler() *StatsHandler {
+	return &StatsHandler{interceptor: i, side: sideClient}
+}
+
+// StatsServerOptions returns the server options that install the stats handler.
+//
+// Example:
+//
+//	s := grpc.NewServer(interceptor.StatsServerOptions()...)
+func (i *GrpcJsonInterceptor) StatsServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{grpc.StatsHandler(i.ServerStatsHandler())}
+}
+
+// StatsDialOptions returns the dial options that install the stats handler.
+//
+// Example:
+//
+//	conn, err := grpc.NewClient(target, append(interceptor.StatsDialOptions(), grpc.WithTransportCredentials(creds))...)
+func (i *GrpcJsonInterceptor) StatsDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithStatsHandler(i.ClientStatsHandler())}
+}
+
+// TagRPC starts capturing the call, or a new attempt of a client call.
+// Capture rules with a peer pattern do not match client calls, since the target is not known to the stats handler.
+func (h *StatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	i := h.interceptor
+	if !i.enabled.Load() {
+		return ctx
+	}
+
+	var matchPeer string
+	if h.side == sideServer {
+		matchPeer = peerAddress(ctx)
+	}
+	if i.rules.Load().excludesCall(info.FullMethodName, matchPeer) {
+		return ctx
+	}
+
+	var c *call
+	if h.side == sideClient {
+		c = h.newAttempt(ctx, info.FullMethodName)
+	} else {
+		c = i.newCall(ctx, info.FullMethodName, h.side, false, matchPeer)
+	}
+	return context.WithValue(ctx, statsCallKey{}, &statsCall{call: c})
+}
+
+// newAttempt creates the state of a client call attempt.
+// The attempts of the same call share the call ID and the sampling decision.
+func (h *StatsHandler) newAttempt(ctx context.Context, method string) *call {
+	c := h.interceptor.newCall(ctx, method, sideClient, false, "")
+	c.attempt = 1
+
+	// The attempts share the context of the call, which gRPC cancels when the call is finished.
+	done := ctx.Done()
+	if done == nil {
+		return c
+	}
+	first, loaded := h.attempts.LoadOrStore(done, &clientCall{id: c.id, sample: c.sample})
+	cc := first.(*clientCall)
+	if !loaded {
+		context.AfterFunc(ctx, func() {
+			h.attempts.Delete(done)
+		})
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.attempts++
+	c.id = cc.id
+	c.sample = cc.sample
+	c.attempt = cc.attempts
+	return c
+}
+
+// HandleRPC captures the events of the call.
+func (h *StatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	sc, ok := ctx.Value(statsCallKey{}).(*statsCall)
+	if !ok {
+		return
+	}
+	i := h.interceptor
+	c := sc.call
+
+	switch s := s.(type) {
+	case *stats.Begin:
+		c.start = s.BeginTime
+		if s.IsClientStream || s.IsServerStream {
+			c.streamId = &c.id
+		}
+		m := i.newStartRecord(ctx, c)
+		m.Time = s.BeginTime.Format(time.RFC3339Nano)
+		m.TransparentRetry = s.IsTransparentRetryAttempt
+		i.emit(c, m)
+
+		// The server receives the headers before the call begins.
+		if sc.inHeader != nil {
+			h.writeHeader(c, recordHeader, directionReceive, sc.inHeader)
+			sc.inHeader = nil
+		}
+
+		// The context of the server call is cancelled also when the call completes normally,
+		// so the cancellation of server calls is seen only in the status of the end record.
+		if c.side == sideClient {
+			i.watchCancel(ctx, c)
+		}
+
+	case *stats.InHeader:
+		if s.RemoteAddr != nil {
+			c.setPeer(addrString(s.RemoteAddr))
+		}
+		if c.side == sideServer {
+			c.codec = serverCodec(s.Header)
+			sc.inHeader = s
+			return
+		}
+		h.writeHeader(c, recordHeader, directionReceive, s)
+
+	case *stats.OutHeader:
+		if s.RemoteAddr != nil {
+			c.setPeer(addrString(s.RemoteAddr))
+		}
+		m := i.newMetadataRecord(c, recordHeader, directionSend, s.Header)
+		m.Compression = s.Compression
+		h.writeMetadataRecord(c, m)
+
+	case *stats.InPayload:
+		h.writePayload(c, directionReceive, s.Payload, s.RecvTime, s.Length, s.CompressedLength, s.WireLength)
+
+	case *stats.OutPayload:
+		h.writePayload(c, directionSend, s.Payload, s.SentTime, s.Length, s.CompressedLength, s.WireLength)
+
+	case *stats.InTrailer:
+		m := i.newMetadataRecord(c, recordTrailer, directionReceive, s.Trailer)
+		m.WireLength = s.WireLength
+		h.writeMetadataRecord(c, m)
+
+	case *stats.OutTrailer:
+		h.writeMetadataRecord(c, i.newMetadataRecord(c, recordTrailer, directionSend, s.Trailer))
+
+	case *stats.End:
+		i.endCall(c, s.Error)
+	}
+}
+
+func (h *StatsHandler) writeHeader(c *call, recordType recordType, direction direction, s *stats.InHeader) {
+	m := h.interceptor.newMetadataRecord(c, recordType, direction, s.Header)
+	m.WireLength = s.WireLength
+	m.Compression = s.Compression
+	h.writeMetadataRecord(c, m)
+}
+
+// writeMetadataRecord writes the record of headers or trailers.
+// Unlike with the interceptors, the record is written even if all keys were filtered out,
+// as long as it carries transport details.
+func (h *StatsHandler) writeMetadataRecord(c *call, m *capturedMessage) {
+	if len(m.Metadata) == 0 && m.WireLength == 0 && m.Compression == "" {
+		return
+	}
+	h.interceptor.emit(c, m)
+}
+
+func (h *StatsHandler) writePayload(c *call, direction direction, payload any, t time.Time, length, compressedLength, wireLength int) {
+	i := h.interceptor
+	m, decision := i.newMessageRecord(c, direction, payload, nil)
+	if m == nil {
+		return
+	}
+	m.Time = t.Format(time.RFC3339Nano)
+	m.PayloadLength = length
+	m.CompressedLength = compressedLength
+	m.WireLength = wireLength
+	i.writeMessageRecord(c, m, decision)
+}
+
+// TagConn does nothing, connections are not captured.
+func (h *StatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn does nothing, connections are not captured.
+func (h *StatsHandler) HandleConn(context.Context, stats.ConnStats) {}
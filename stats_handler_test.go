@@ -0,0 +1,118 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/tsaarni/grpc-json-sniffer/example/demo"
+)
+
+const retryServiceConfig = `{
+	"methodConfig": [{
+		"name": [{"service": "test.Test"}],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.01s",
+			"maxBackoff": "0.01s",
+			"backoffMultiplier": 1,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+func TestStatsHandler(t *testing.T) {
+	server, serverSink := newTestInterceptor(t)
+	client, clientSink := newTestInterceptor(t)
+	conn, stop := startTestServer(t, server.StatsServerOptions(), append(client.StatsDialOptions(), grpc.WithDefaultServiceConfig(retryServiceConfig))...)
+
+	// The first call is retried once, the calls run concurrently to catch races with the peer address.
+	var wg sync.WaitGroup
+	for _, name := range []string{"retry", "a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := conn.Invoke(context.Background(), "/test.Test/Unary", &demo.HelloRequest{Name: name}, &demo.HelloReply{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// The headers of a stream are received while the messages are being sent.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := bidiConcurrently(conn, 20); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+	stop()
+
+	// The attempts of a client call share the call ID, each call has its own.
+	attempts := map[float64][]float64{}
+	names := map[float64]string{}
+	for _, r := range capturedRecords(t, client, clientSink) {
+		callId := r["call_id"].(float64)
+		switch r["type"] {
+		case string(recordStart):
+			attempts[callId] = append(attempts[callId], r["attempt"].(float64))
+		case string(recordMessage):
+			if r["direction"] == string(directionSend) && names[callId] == "" {
+				names[callId] = r["content"].(map[string]any)["name"].(string)
+			}
+		}
+		// The peer is known once the headers are sent.
+		if r["type"] != string(recordStart) && r["peer_address"] != "bufconn" {
+			t.Errorf("got peer_address %v in %v", r["peer_address"], r)
+		}
+	}
+	if len(attempts) != 4 {
+		t.Fatalf("got attempts %v, want 4 calls", attempts)
+	}
+	for callId, got := range attempts {
+		want := []float64{1}
+		if names[callId] == "retry" {
+			want = []float64{1, 2}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got attempts %v of call %q, want %v", got, names[callId], want)
+		}
+	}
+
+	// Each attempt is a separate call on the server.
+	serverCalls := map[float64]bool{}
+	for _, r := range capturedRecords(t, server, serverSink) {
+		serverCalls[r["call_id"].(float64)] = true
+		if r["peer_address"] != "bufconn" {
+			t.Errorf("got peer_address %v in %v", r["peer_address"], r)
+		}
+	}
+	if len(serverCalls) != 5 {
+		t.Errorf("got %d server calls, want 5", len(serverCalls))
+	}
+}
+
+// bidiConcurrently sends messages on a bidirectional stream while receiving the responses.
+func bidiConcurrently(conn *grpc.ClientConn, messages int) error {
+	stream, err := conn.NewStream(context.Background(), bidiDesc, "/test.Test/Bidi")
+	if err != nil {
+		return err
+	}
+	sent := make(chan error, 1)
+	go func() {
+		for range messages {
+			if err := stream.SendMsg(&demo.HelloRequest{Name: "bidi"}); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+	if err := recvAll(stream); err != nil {
+		return err
+	}
+	return <-sent
+}
@@ -0,0 +1,44 @@
+package grpc_json_sniffer
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	// Register the standard error detail types, so that they can be decoded to JSON.
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+// capturedStatus is the gRPC status of a failed call, with the error details decoded to JSON.
+type capturedStatus struct {
+	Code     int               `json:"code"`
+	CodeName string            `json:"code_name"`
+	Message  string            `json:"message"`
+	Details  []json.RawMessage `json:"details,omitempty"`
+
+	types []protoreflect.MessageDescriptor // Types of the error details.
+}
+
+// newStatus converts the error to a structured status.
+// Errors that do not carry a gRPC status are reported with code Unknown.
+// The error details are redacted like the messages.
+func (i *GrpcJsonInterceptor) newStatus(err error) *capturedStatus {
+	st := status.Convert(err)
+	s := &capturedStatus{
+		Code:     int(st.Code()),
+		CodeName: st.Code().String(),
+		Message:  st.Message(),
+	}
+	for _, detail := range st.Proto().GetDetails() {
+		b, err := i.marshaler.Marshal(i.redactor.redactMessage(detail))
+		if err != nil {
+			// The detail type is not linked into the binary, record at least its type.
+			b, _ = json.Marshal(map[string]string{"@type": detail.GetTypeUrl()})
+		} else if mt, err := i.typeCollector.resolver.FindMessageByURL(detail.GetTypeUrl()); err == nil {
+			s.types = append(s.types, mt.Descriptor())
+		}
+		s.Details = append(s.Details, json.RawMessage(b))
+	}
+	return s
+}
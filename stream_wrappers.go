@@ -1,43 +1,135 @@
 package grpc_json_sniffer
 
 import (
+	"context"
+	"errors"
+	"io"
+
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 type serverStreamWrapper struct {
 	grpc.ServerStream
-	info        *grpc.StreamServerInfo
 	interceptor *GrpcJsonInterceptor
-	streamId    int64
+	call        *call
+}
+
+// Context returns the context of the stream, with the transport stream wrapped
+// to capture headers and trailers set with grpc.SetHeader and friends.
+func (ssw *serverStreamWrapper) Context() context.Context {
+	return ssw.call.ctx
 }
 
 func (ssw *serverStreamWrapper) RecvMsg(m interface{}) error {
 	err := ssw.ServerStream.RecvMsg(m)
-	ssw.interceptor.writeMessage(ssw.Context(), directionReceive, ssw.info.FullMethod, m, err, &ssw.streamId)
+	switch {
+	case err == nil:
+		ssw.interceptor.writeMessage(ssw.call, directionReceive, m, nil)
+	case errors.Is(err, io.EOF):
+		ssw.interceptor.halfClose(ssw.call, directionReceive)
+	}
+	// Other errors end the call, and are captured when the handler returns.
 	return err
 }
 
 func (ssw *serverStreamWrapper) SendMsg(m interface{}) error {
 	err := ssw.ServerStream.SendMsg(m)
-	ssw.interceptor.writeMessage(ssw.Context(), directionSend, ssw.info.FullMethod, m, err, &ssw.streamId)
+	// Headers are sent at the latest together with the first message.
+	ssw.interceptor.sendHeader(ssw.call, nil)
+	ssw.interceptor.writeMessage(ssw.call, directionSend, m, err)
+	return err
+}
+
+func (ssw *serverStreamWrapper) SetHeader(md metadata.MD) error {
+	err := ssw.ServerStream.SetHeader(md)
+	if err == nil {
+		ssw.interceptor.setHeader(ssw.call, md)
+	}
 	return err
 }
 
+func (ssw *serverStreamWrapper) SendHeader(md metadata.MD) error {
+	err := ssw.ServerStream.SendHeader(md)
+	if err == nil {
+		ssw.interceptor.sendHeader(ssw.call, md)
+	}
+	return err
+}
+
+func (ssw *serverStreamWrapper) SetTrailer(md metadata.MD) {
+	ssw.ServerStream.SetTrailer(md)
+	ssw.interceptor.setTrailer(ssw.call, md)
+}
+
 type clientStreamWrapper struct {
 	grpc.ClientStream
 	interceptor *GrpcJsonInterceptor
-	method      string
-	streamId    int64
+	call        *call
+	desc        *grpc.StreamDesc
+	peer        *peer.Peer // Filled in by gRPC when the stream ends.
 }
 
 func (csw *clientStreamWrapper) SendMsg(m interface{}) error {
 	err := csw.ClientStream.SendMsg(m)
-	csw.interceptor.writeMessage(csw.Context(), directionSend, csw.method, m, err, &csw.streamId)
+	// io.EOF means the stream was ended by the server, the status is captured by RecvMsg.
+	if !errors.Is(err, io.EOF) {
+		csw.interceptor.writeMessage(csw.call, directionSend, m, err)
+	}
+	return err
+}
+
+func (csw *clientStreamWrapper) CloseSend() error {
+	err := csw.ClientStream.CloseSend()
+	csw.interceptor.halfClose(csw.call, directionSend)
 	return err
 }
 
 func (csw *clientStreamWrapper) RecvMsg(m interface{}) error {
 	err := csw.ClientStream.RecvMsg(m)
-	csw.interceptor.writeMessage(csw.Context(), directionReceive, csw.method, m, err, &csw.streamId)
+	// Headers have been received once a message or the status has arrived, so Header() does not block.
+	if md, headerErr := csw.ClientStream.Header(); headerErr == nil {
+		csw.interceptor.recvHeader(csw.call, md)
+	}
+	if err == nil {
+		csw.interceptor.writeMessage(csw.call, directionReceive, m, nil)
+		// Without server streaming, gRPC has already received the status together with the single response,
+		// and the application has no reason to call RecvMsg again to see io.EOF.
+		if !csw.desc.ServerStreams {
+			csw.end(nil)
+		}
+		return nil
+	}
+
+	// The stream has ended, io.EOF means the call completed successfully.
+	if errors.Is(err, io.EOF) {
+		csw.end(nil)
+	} else {
+		csw.end(err)
+	}
 	return err
 }
+
+// end captures the trailers and the end of the call.
+func (csw *clientStreamWrapper) end(err error) {
+	if csw.peer.Addr != nil {
+		csw.call.setPeer(addrString(csw.peer.Addr))
+	}
+	csw.interceptor.recvTrailer(csw.call, csw.ClientStream.Trailer())
+	csw.interceptor.endCall(csw.call, err)
+}
+
+func (csw *clientStreamWrapper) Header() (metadata.MD, error) {
+	md, err := csw.ClientStream.Header()
+	if err == nil {
+		csw.interceptor.recvHeader(csw.call, md)
+	}
+	return md, err
+}
+
+func (csw *clientStreamWrapper) Trailer() metadata.MD {
+	md := csw.ClientStream.Trailer()
+	csw.interceptor.recvTrailer(csw.call, md)
+	return md
+}
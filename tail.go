@@ -8,22 +8,134 @@ import (
 	"time"
 )
 
-func tailFile(ctx context.Context, file *os.File, lines chan string) {
+// pollInterval is how often the file is checked for changes when change notifications are not available.
+const pollInterval = 100 * time.Millisecond
+
+// fileWatcher waits for changes to the file being tailed.
+type fileWatcher interface {
+	// wait returns when the file may have changed, or false if the context is done.
+	wait() bool
+	close()
+}
+
+// tailFile sends the lines of the file to the channel, and keeps following the file as it grows.
+//
+// A line is sent only when it is complete, a partial line at the end of the file is held until the rest is written.
+// If the file is rotated, the rest of the old file is read before continuing with the new file at the same path.
+// If the file is truncated, it is read again from the start.
+// The synced function is called once, when the lines already in the file have been sent.
+// The channel is closed when the context is done, or if the file cannot be read.
+// The file is closed when tailFile returns.
+func tailFile(ctx context.Context, filename string, file *os.File, lines chan<- string, synced func()) {
+	tailFileWith(ctx, filename, file, newFileWatcher(ctx, filename), lines, synced)
+}
+
+// tailFileWith is tailFile with the given watcher, which is closed when tailFileWith returns.
+func tailFileWith(ctx context.Context, filename string, file *os.File, watcher fileWatcher, lines chan<- string, synced func()) {
+	defer close(lines)
+	defer func() {
+		_ = file.Close()
+	}()
+	defer watcher.close()
+
 	reader := bufio.NewReader(file)
+	var partial []byte
 	for {
-		select {
-		case <-ctx.Done():
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			if len(partial) > 0 {
+				line = append(partial, line...)
+				partial = nil
+			}
+			select {
+			case lines <- string(line):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		if err != io.EOF {
 			return
-		default:
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					time.Sleep(100 * time.Millisecond)
-					continue
-				}
+		}
+
+		// Hold the partial line until the rest of it is written.
+		partial = append(partial, line...)
+
+		switch next, truncated := checkFile(filename, file); {
+		case next != nil:
+			// The old file has been read to the end, continue with the new one.
+			// A partial line at the end of the old file is never completed.
+			_ = file.Close()
+			file = next
+			reader.Reset(file)
+			partial = nil
+			continue
+		case truncated:
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
 				return
 			}
-			lines <- line
+			reader.Reset(file)
+			partial = nil
+			continue
+		}
+
+		if synced != nil {
+			synced()
+			synced = nil
+		}
+		if !watcher.wait() {
+			return
 		}
 	}
 }
+
+// checkFile checks if the file being read has been rotated away or truncated.
+// It returns the new file at the path if the file has been rotated,
+// or true if the file has been truncated below the current read position.
+// It must be called only when the file has been read to the end.
+func checkFile(filename string, file *os.File) (*os.File, bool) {
+	current, err := file.Stat()
+	if err != nil {
+		return nil, false
+	}
+	position, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	if current.Size() < position {
+		return nil, true
+	}
+
+	latest, err := os.Stat(filename)
+	if err != nil || os.SameFile(current, latest) {
+		return nil, false
+	}
+	// Read the remaining lines of the old file before switching.
+	if position < current.Size() {
+		return nil, false
+	}
+	next, err := os.Open(filename)
+	if err != nil {
+		return nil, false
+	}
+	return next, false
+}
+
+// pollingWatcher waits for changes by sleeping, for platforms without change notifications.
+type pollingWatcher struct {
+	ctx context.Context
+}
+
+// wait returns after the poll interval, or false if the context is done.
+func (w *pollingWatcher) wait() bool {
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+func (w *pollingWatcher) close() {}
@@ -0,0 +1,97 @@
+package grpc_json_sniffer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rescanInterval is how often the file is checked even without notifications,
+// in case a change was not notified, for example on a network filesystem.
+const rescanInterval = time.Second
+
+// inotifyWatcher waits for inotify events about the file being tailed.
+//
+// The directory is watched instead of the file, so that the creation of a new file by rotation is seen as well.
+type inotifyWatcher struct {
+	ctx    context.Context
+	file   *os.File // The inotify instance.
+	name   string   // Name of the file in the directory.
+	stop   func() bool
+	events []byte
+}
+
+// newFileWatcher returns a watcher using inotify, or a polling watcher if inotify is not available.
+func newFileWatcher(ctx context.Context, filename string) fileWatcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return &pollingWatcher{ctx: ctx}
+	}
+	const mask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(filename), mask); err != nil {
+		_ = syscall.Close(fd)
+		return &pollingWatcher{ctx: ctx}
+	}
+
+	// The non-blocking descriptor is handled by the runtime poller, which allows read deadlines.
+	w := &inotifyWatcher{
+		ctx:    ctx,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		name:   filepath.Base(filename),
+		events: make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)),
+	}
+	// Interrupt a read in progress when the context is done.
+	w.stop = context.AfterFunc(ctx, func() {
+		_ = w.file.SetReadDeadline(time.Now())
+	})
+	return w
+}
+
+// wait returns when there is an event about the file, after the rescan interval, or false if the context is done.
+func (w *inotifyWatcher) wait() bool {
+	deadline := time.Now().Add(rescanInterval)
+	for w.ctx.Err() == nil {
+		if err := w.file.SetReadDeadline(deadline); err != nil {
+			return false
+		}
+		n, err := w.file.Read(w.events)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return w.ctx.Err() == nil
+		}
+		if err != nil {
+			return false
+		}
+		if w.aboutFile(w.events[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// aboutFile returns true if any of the events concern the file, or if the events were lost.
+func (w *inotifyWatcher) aboutFile(events []byte) bool {
+	for len(events) >= syscall.SizeofInotifyEvent {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&events[0]))
+		end := syscall.SizeofInotifyEvent + int(event.Len)
+		if end > len(events) {
+			return true
+		}
+		name := string(bytes.TrimRight(events[syscall.SizeofInotifyEvent:end], "\x00"))
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 || name == w.name {
+			return true
+		}
+		events = events[end:]
+	}
+	return false
+}
+
+func (w *inotifyWatcher) close() {
+	w.stop()
+	_ = w.file.Close()
+}
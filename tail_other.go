@@ -0,0 +1,10 @@
+//go:build !linux
+
+package grpc_json_sniffer
+
+import "context"
+
+// newFileWatcher returns a watcher that polls the file, change notifications are used only on Linux.
+func newFileWatcher(ctx context.Context, _ string) fileWatcher {
+	return &pollingWatcher{ctx: ctx}
+}
@@ -0,0 +1,106 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTailFile(t *testing.T) {
+	watchers := []struct {
+		name       string
+		newWatcher func(ctx context.Context, filename string) fileWatcher
+	}{
+		{"platform", newFileWatcher}, // inotify on Linux.
+		{"polling", func(ctx context.Context, _ string) fileWatcher { return &pollingWatcher{ctx: ctx} }},
+	}
+	for _, w := range watchers {
+		t.Run(w.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "capture.json")
+			out, err := os.Create(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close() //nolint:errcheck
+			write := func(f *os.File, s string) {
+				t.Helper()
+				if _, err := f.WriteString(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			write(out, "a\nb")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			in, err := os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := make(chan string)
+			synced := make(chan struct{})
+			go tailFileWith(ctx, filename, in, w.newWatcher(ctx, filename), lines, func() { close(synced) })
+
+			expect := func(want string) {
+				t.Helper()
+				select {
+				case got, ok := <-lines:
+					if !ok {
+						t.Fatalf("channel closed, want %q", want)
+					}
+					if got != want {
+						t.Fatalf("got %q, want %q", got, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out waiting for %q", want)
+				}
+			}
+
+			// The partial line is held until it is complete.
+			expect("a\n")
+			select {
+			case <-synced:
+			case <-time.After(5 * time.Second):
+				t.Fatal("synced was not called")
+			}
+			write(out, "c\n")
+			expect("bc\n")
+
+			// A truncated file is read again from the start.
+			if err := out.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := out.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			write(out, "d\n")
+			expect("d\n")
+
+			// The rest of a rotated file is read before continuing with the new file.
+			if err := os.Rename(filename, filename+".1"); err != nil {
+				t.Fatal(err)
+			}
+			write(out, "e\n")
+			expect("e\n")
+			next, err := os.Create(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer next.Close() //nolint:errcheck
+			write(next, "f\n")
+			expect("f\n")
+
+			// The channel is closed when the context is cancelled.
+			cancel()
+			select {
+			case line, ok := <-lines:
+				if ok {
+					t.Fatalf("got %q after cancel, want the channel closed", line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("channel was not closed after cancel")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// TraceExtractor returns the trace and span IDs of the span in the context, as lowercase hex strings.
+// It returns false if the context has no span.
+//
+// For example, with OpenTelemetry:
+//
+//	func(ctx context.Context) (string, string, bool) {
+//		sc := trace.SpanContextFromContext(ctx)
+//		return sc.TraceID().String(), sc.SpanID().String(), sc.IsValid()
+//	}
+type TraceExtractor func(ctx context.Context) (traceId, spanId string, ok bool)
+
+// traceContext returns the trace and span IDs of the call.
+// The span in the context takes precedence over the W3C traceparent header in the metadata,
+// since tracing libraries often add the header only when the request is sent on the wire.
+func (i *GrpcJsonInterceptor) traceContext(ctx context.Context, md metadata.MD) (traceId, spanId string) {
+	if i.traceExtractor != nil {
+		if traceId, spanId, ok := i.traceExtractor(ctx); ok {
+			return traceId, spanId
+		}
+	}
+	for _, traceparent := range md.Get("traceparent") {
+		if traceId, spanId, ok := parseTraceparent(traceparent); ok {
+			return traceId, spanId
+		}
+	}
+	return "", ""
+}
+
+// requestMetadata returns the request headers of the call: incoming on the server and outgoing on the client.
+func requestMetadata(ctx context.Context, side side) metadata.MD {
+	if side == sideServer {
+		md, _ := metadata.FromIncomingContext(ctx)
+		return md
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	return md
+}
+
+// parseTraceparent parses the W3C Trace Context traceparent header, for example
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(s string) (traceId, spanId string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return "", "", false
+	}
+	version, traceId, spanId, flags := parts[0], parts[1], parts[2], parts[3]
+	// Future versions may add fields, but version 00 has exactly four.
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", "", false
+	}
+	if !isLowerHex(traceId, 32) || !isLowerHex(spanId, 16) || !isLowerHex(flags, 2) {
+		return "", "", false
+	}
+	if strings.Trim(traceId, "0") == "" || strings.Trim(spanId, "0") == "" {
+		return "", "", false
+	}
+	return traceId, spanId, true
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for n := 0; n < len(s); n++ {
+		if (s[n] < '0' || s[n] > '9') && (s[n] < 'a' || s[n] > 'f') {
+			return false
+		}
+	}
+	return true
+}
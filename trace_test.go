@@ -0,0 +1,48 @@
+package grpc_json_sniffer
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanId  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", "00-" + traceId + "-" + spanId + "-01", true},
+		{"not sampled", "00-" + traceId + "-" + spanId + "-00", true},
+		{"surrounding whitespace", " 00-" + traceId + "-" + spanId + "-01 ", true},
+		{"future version", "01-" + traceId + "-" + spanId + "-01", true},
+		{"future version with more fields", "01-" + traceId + "-" + spanId + "-01-extra", true},
+		{"empty", "", false},
+		{"too few fields", "00-" + traceId + "-" + spanId, false},
+		{"version 00 with more fields", "00-" + traceId + "-" + spanId + "-01-extra", false},
+		{"version ff", "ff-" + traceId + "-" + spanId + "-01", false},
+		{"short version", "0-" + traceId + "-" + spanId + "-01", false},
+		{"all-zero trace ID", "00-00000000000000000000000000000000-" + spanId + "-01", false},
+		{"all-zero span ID", "00-" + traceId + "-0000000000000000-01", false},
+		{"short trace ID", "00-" + traceId[1:] + "-" + spanId + "-01", false},
+		{"long span ID", "00-" + traceId + "-" + spanId + "0-01", false},
+		{"short flags", "00-" + traceId + "-" + spanId + "-1", false},
+		{"uppercase trace ID", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanId + "-01", false},
+		{"non-hex span ID", "00-" + traceId + "-00f067aa0ba902bx-01", false},
+		{"non-hex flags", "00-" + traceId + "-" + spanId + "-0g", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotTrace, gotSpan, ok := parseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.ok)
+			}
+			if ok && (gotTrace != traceId || gotSpan != spanId) {
+				t.Errorf("parseTraceparent(%q) = %q, %q, want %q, %q", tt.header, gotTrace, gotSpan, traceId, spanId)
+			}
+			if !ok && (gotTrace != "" || gotSpan != "") {
+				t.Errorf("parseTraceparent(%q) = %q, %q, want empty IDs", tt.header, gotTrace, gotSpan)
+			}
+		})
+	}
+}
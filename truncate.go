@@ -0,0 +1,257 @@
+package grpc_json_sniffer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// SizeLimits limits the size of the captured messages, so that large payloads do not make
+// the capture file and the web viewer unusable.
+//
+// Zero values disable the corresponding limit.
+// Every shortened field is listed in the "truncated" field of the record.
+type SizeLimits struct {
+	// MaxRecordSize is the maximum size in bytes of the content of a message record, including the raw payload.
+	// The content of larger messages is left out and the record is marked with "content_omitted".
+	MaxRecordSize int
+
+	// MaxFieldSize is the maximum length in bytes of string and bytes fields.
+	// Longer values are cut to this length.
+	MaxFieldSize int
+
+	// MaxRepeated is the maximum number of elements of repeated fields and maps.
+	// Further elements are left out.
+	MaxRepeated int
+}
+
+// truncatedField describes a field of the message that was shortened by the size limits.
+type truncatedField struct {
+	Path   string `json:"path"`   // Path of the field in the message, for example "files[2].data".
+	Length int    `json:"length"` // Original length of the value in bytes, or number of elements.
+}
+
+// truncator shortens the fields of messages that exceed the size limits.
+type truncator struct {
+	limits SizeLimits
+}
+
+func newTruncator(limits SizeLimits) *truncator {
+	return &truncator{limits: limits}
+}
+
+// truncateMessage returns the message with the fields that exceed the limits shortened, and the list of shortened fields.
+// The original message is not modified, a copy is made if anything needs to be shortened.
+func (t *truncator) truncateMessage(msg proto.Message) (proto.Message, []truncatedField) {
+	if t.limits.MaxFieldSize <= 0 && t.limits.MaxRepeated <= 0 {
+		return msg, nil
+	}
+	if !t.exceeds(msg.ProtoReflect()) {
+		return msg, nil
+	}
+	clone := proto.Clone(msg)
+	return clone, t.truncate(clone.ProtoReflect(), "", nil)
+}
+
+// exceeds returns true if any field of the message exceeds the limits.
+func (t *truncator) exceeds(m protoreflect.Message) bool {
+	// The packed message of an Any is opaque bytes that cannot be shortened without breaking it.
+	if m.Descriptor().FullName() == anyFullName {
+		return false
+	}
+	found := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if t.repeatedExceeds(v.Map().Len()) {
+				found = true
+				break
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				found = t.valueExceeds(fd.MapValue(), v)
+				return !found
+			})
+		case fd.IsList():
+			list := v.List()
+			if t.repeatedExceeds(list.Len()) {
+				found = true
+				break
+			}
+			for n := 0; n < list.Len() && !found; n++ {
+				found = t.valueExceeds(fd, list.Get(n))
+			}
+		default:
+			found = t.valueExceeds(fd, v)
+		}
+		return !found
+	})
+	return found
+}
+
+func (t *truncator) valueExceeds(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return t.fieldExceeds(len(v.String()))
+	case protoreflect.BytesKind:
+		return t.fieldExceeds(len(v.Bytes()))
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return t.exceeds(v.Message())
+	}
+	return false
+}
+
+func (t *truncator) fieldExceeds(length int) bool {
+	return t.limits.MaxFieldSize > 0 && length > t.limits.MaxFieldSize
+}
+
+func (t *truncator) repeatedExceeds(length int) bool {
+	return t.limits.MaxRepeated > 0 && length > t.limits.MaxRepeated
+}
+
+// truncate shortens the fields of the message in place and appends them to the list of shortened fields.
+func (t *truncator) truncate(m protoreflect.Message, path string, truncated []truncatedField) []truncatedField {
+	if m.Descriptor().FullName() == anyFullName {
+		return truncated
+	}
+
+	// Collect the fields first, the message must not be modified while iterating over it.
+	type field struct {
+		fd protoreflect.FieldDescriptor
+		v  protoreflect.Value
+	}
+	var fields []field
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fields = append(fields, field{fd, v})
+		return true
+	})
+
+	for _, f := range fields {
+		fieldPath := string(f.fd.Name())
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		switch {
+		case f.fd.IsMap():
+			truncated = t.truncateMap(f.fd, f.v.Map(), fieldPath, truncated)
+		case f.fd.IsList():
+			truncated = t.truncateList(f.fd, f.v.List(), fieldPath, truncated)
+		default:
+			var v protoreflect.Value
+			v, truncated = t.truncateValue(f.fd, f.v, fieldPath, truncated)
+			if f.fd.Message() == nil {
+				m.Set(f.fd, v)
+			}
+		}
+	}
+	return truncated
+}
+
+func (t *truncator) truncateList(fd protoreflect.FieldDescriptor, list protoreflect.List, path string, truncated []truncatedField) []truncatedField {
+	if t.repeatedExceeds(list.Len()) {
+		truncated = append(truncated, truncatedField{Path: path, Length: list.Len()})
+		list.Truncate(t.limits.MaxRepeated)
+	}
+	for n := 0; n < list.Len(); n++ {
+		var v protoreflect.Value
+		v, truncated = t.truncateValue(fd, list.Get(n), path+"["+strconv.Itoa(n)+"]", truncated)
+		if fd.Message() == nil {
+			list.Set(n, v)
+		}
+	}
+	return truncated
+}
+
+func (t *truncator) truncateMap(fd protoreflect.FieldDescriptor, fieldMap protoreflect.Map, path string, truncated []truncatedField) []truncatedField {
+	var keys []protoreflect.MapKey
+	fieldMap.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	// Map iteration order is random, the kept entries are chosen in key order to keep the capture stable.
+	sortMapKeys(keys)
+	if t.repeatedExceeds(len(keys)) {
+		truncated = append(truncated, truncatedField{Path: path, Length: len(keys)})
+		for _, k := range keys[t.limits.MaxRepeated:] {
+			fieldMap.Clear(k)
+		}
+		keys = keys[:t.limits.MaxRepeated]
+	}
+	for _, k := range keys {
+		var v protoreflect.Value
+		v, truncated = t.truncateValue(fd.MapValue(), fieldMap.Get(k), fmt.Sprintf("%s[%v]", path, k.Interface()), truncated)
+		if fd.MapValue().Message() == nil {
+			fieldMap.Set(k, v)
+		}
+	}
+	return truncated
+}
+
+// truncateValue returns the value shortened to the limits.
+// Messages are shortened in place.
+func (t *truncator) truncateValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, path string, truncated []truncatedField) (protoreflect.Value, []truncatedField) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		if s := v.String(); t.fieldExceeds(len(s)) {
+			truncated = append(truncated, truncatedField{Path: path, Length: len(s)})
+			return protoreflect.ValueOfString(truncateString(s, t.limits.MaxFieldSize)), truncated
+		}
+	case protoreflect.BytesKind:
+		if b := v.Bytes(); t.fieldExceeds(len(b)) {
+			truncated = append(truncated, truncatedField{Path: path, Length: len(b)})
+			return protoreflect.ValueOfBytes(b[:t.limits.MaxFieldSize:t.limits.MaxFieldSize]), truncated
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		truncated = t.truncate(v.Message(), path, truncated)
+	}
+	return v, truncated
+}
+
+// recordExceeds returns true if the content and the raw payload of a record exceed the maximum record size.
+// The raw payload is counted as its base64 encoding in the record.
+func (t *truncator) recordExceeds(content []byte, raw []byte) bool {
+	return t.limits.MaxRecordSize > 0 && len(content)+base64.StdEncoding.EncodedLen(len(raw)) > t.limits.MaxRecordSize
+}
+
+// sortMapKeys sorts the keys of a map field.
+func sortMapKeys(keys []protoreflect.MapKey) {
+	sort.Slice(keys, func(a, b int) bool {
+		switch keys[a].Interface().(type) {
+		case string:
+			return keys[a].String() < keys[b].String()
+		case bool:
+			return !keys[a].Bool() && keys[b].Bool()
+		case int32, int64:
+			return keys[a].Int() < keys[b].Int()
+		case uint32, uint64:
+			return keys[a].Uint() < keys[b].Uint()
+		}
+		return false
+	})
+}
+
+// truncateString cuts the string to at most max bytes, without splitting a multi-byte character.
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	// Back up to the start of the character that crosses the limit.
+	for n := max; n >= 0 && n > max-utf8.UTFMax; n-- {
+		if utf8.RuneStart(s[n]) {
+			return s[:n]
+		}
+	}
+	return s[:max]
+}
+
+// contentHash returns the SHA-256 hash of the serialized payload as a hex string.
+func contentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
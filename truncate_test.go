@@ -0,0 +1,57 @@
+package grpc_json_sniffer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tsaarni/grpc-json-sniffer/example/demo"
+)
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"", 0, ""},
+		{"hello", 0, ""},
+		{"hello", 3, "hel"},
+		{"hello", 5, "hello"},
+		{"hello", 10, "hello"},
+		{"héllo", 1, "h"},  // "é" is two bytes.
+		{"héllo", 2, "h"},  // Cut inside "é".
+		{"héllo", 3, "hé"}, // Cut after "é".
+		{"€uro", 1, ""},    // "€" is three bytes.
+		{"€uro", 2, ""},
+		{"€uro", 3, "€"},
+		{"a😀b", 2, "a"}, // "😀" is four bytes.
+		{"a😀b", 4, "a"},
+		{"a😀b", 5, "a😀"},
+		{"😀😀", 7, "😀"},
+		// Invalid bytes before the cut are kept as they are.
+		{"a\xffbc", 2, "a\xff"},
+		{"\x80\x80\x80\x80\x80\x80", 5, "\x80\x80\x80\x80\x80"},
+	}
+	for _, tt := range tests {
+		if got := truncateString(tt.s, tt.max); got != tt.want {
+			t.Errorf("truncateString(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	msg := &demo.HelloRequest{Name: "héllo"}
+	tr := newTruncator(SizeLimits{MaxFieldSize: 2})
+
+	got, truncated := tr.truncateMessage(msg)
+	if name := got.(*demo.HelloRequest).GetName(); name != "h" {
+		t.Errorf("got name %q, want %q", name, "h")
+	}
+	want := []truncatedField{{Path: "name", Length: 6}}
+	if !reflect.DeepEqual(truncated, want) {
+		t.Errorf("got truncated %+v, want %+v", truncated, want)
+	}
+	if msg.GetName() != "héllo" {
+		t.Error("original message was modified")
+	}
+}
@@ -1,44 +1,176 @@
 package grpc_json_sniffer
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/fs"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coder/websocket"
 )
 
+// GrpcWebViewer serves a web interface that shows the captured messages as they are written to the file,
+// or to the memory buffer.
 type GrpcWebViewer struct {
 	publicFiles fs.FS
 	addr        string
-	messages    string
+	messages    string    // Capture file, empty if the records are served from the ring.
+	ring        *RingSink // Records kept in memory, nil if the records are served from the file.
+	server      *http.Server
+	options     grpcWebViewerOptions
+	capture     *sharedCapture // Capture controlled through the control endpoint, nil if none.
+	hub         *hub           // Broadcasts the captured records to the web clients.
+	api         http.Handler   // Query API over the records kept by the hub.
+
+	// Cancelled on shutdown, to close the websocket connections that the HTTP server does not track.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	sessions sync.WaitGroup
+}
+
+type grpcWebViewerOptions struct {
+	TraceURL   string
+	MaxRecords int
 }
 
-func NewGrpcWebViewer(addr string, messages string) *GrpcWebViewer {
-	return &GrpcWebViewer{
+// NewGrpcWebViewer creates a web viewer serving the messages captured to the given file.
+//
+// It can be configured using the environment variable:
+// - GRPC_JSON_SNIFFER_TRACE_URL: links the trace IDs to a tracing UI, see WithTraceURL.
+//
+// Alternatively, it can be configured through options:
+// - WithTraceURL: links the trace IDs to a tracing UI.
+// - WithMaxRecords: sets the number of records kept in memory for the web clients.
+//
+// The capture is read once, and the records are shared by all web clients.
+func NewGrpcWebViewer(addr string, messages string, options ...func(*grpcWebViewerOptions)) *GrpcWebViewer {
+	opts := grpcWebViewerOptions{
+		TraceURL: os.Getenv("GRPC_JSON_SNIFFER_TRACE_URL"),
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &GrpcWebViewer{
 		addr:        addr,
 		messages:    messages,
 		publicFiles: getStaticFiles(),
+		options:     opts,
+		ctx:         ctx,
+		cancel:      cancel,
 	}
-}
-
-func (v *GrpcWebViewer) Serve() {
-	server := &http.Server{
-		Addr:              v.addr,
+	v.hub = newHub(ctx, v.ingest, opts.MaxRecords)
+	v.api = v.newAPIHandler()
+	v.server = &http.Server{
+		Addr:              addr,
 		ReadHeaderTimeout: time.Duration(5) * time.Second,
 		Handler:           v,
 	}
-	err := server.ListenAndServe()
+	return v
+}
+
+// NewRingWebViewer creates a web viewer serving the records kept in memory by the ring sink.
+// It accepts the same options as NewGrpcWebViewer.
+func NewRingWebViewer(addr string, ring *RingSink, options ...func(*grpcWebViewerOptions)) *GrpcWebViewer {
+	v := NewGrpcWebViewer(addr, "", options...)
+	v.ring = ring
+	return v
+}
+
+// WithTraceURL sets the URL template that turns the trace ID of a record into a link to a tracing UI.
+//
+// The placeholders {trace_id} and {span_id} are replaced with the IDs of the record.
+//
+// Example:
+//
+//	viewer := NewGrpcWebViewer("localhost:8080", "grpc_messages.json", WithTraceURL("http://localhost:16686/trace/{trace_id}"))
+func WithTraceURL(template string) func(*grpcWebViewerOptions) {
+	return func(o *grpcWebViewerOptions) {
+		o.TraceURL = template
+	}
+}
+
+// WithMaxRecords sets the number of latest records the web viewer keeps in memory.
+//
+// A web client that connects receives these records first, and then the new records as they are captured.
+// If zero or negative, 100000 records are kept.
+//
+// Example:
+//
+//	viewer := NewGrpcWebViewer("localhost:8080", "grpc_messages.json", WithMaxRecords(10000))
+func WithMaxRecords(records int) func(*grpcWebViewerOptions) {
+	return func(o *grpcWebViewerOptions) {
+		o.MaxRecords = records
+	}
+}
+
+// ingest sends the captured records to the hub, from the ring or by following the capture file.
+// The synced function is called when the records captured so far have been sent.
+// The channel is closed when the records can no longer be read.
+func (v *GrpcWebViewer) ingest(ctx context.Context, lines chan<- string, synced func()) {
+	if v.ring != nil {
+		v.ring.follow(ctx, lines, synced)
+		close(lines)
+		return
+	}
+	file, err := os.Open(v.messages)
 	if err != nil {
-		panic(err)
+		close(lines)
+		return
 	}
+	tailFile(ctx, v.messages, file, lines, synced)
+}
+
+// Serve listens on the address of the viewer and serves the web interface until Shutdown is called.
+// It returns nil after Shutdown, or the error that stopped the server, such as the address being in use.
+func (v *GrpcWebViewer) Serve() error {
+	l, err := net.Listen("tcp", v.addr)
+	if err != nil {
+		return err
+	}
+	return v.ServeListener(l)
+}
+
+// ServeListener serves the web interface on the given listener until Shutdown is called.
+// The listener is closed when the server stops.
+func (v *GrpcWebViewer) ServeListener(l net.Listener) error {
+	err := v.server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the server gracefully.
+// It stops accepting new connections, closes the websocket connections of the web clients,
+// and waits for them to finish until the context expires.
+func (v *GrpcWebViewer) Shutdown(ctx context.Context) error {
+	err := v.server.Shutdown(ctx)
+	v.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		v.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.Join(err, ctx.Err())
+	}
+	return err
 }
 
 func (v *GrpcWebViewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -46,51 +178,189 @@ func (v *GrpcWebViewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		v.messagesHandler(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		v.api.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/control" {
+		v.controlHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/download" {
+		v.downloadHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/config" {
+		v.configHandler(w, r)
+		return
+	}
 
 	v.filesHandler(w, r)
 }
 
+// heartbeatInterval is how often a heartbeat is sent to the web clients,
+// so that they can tell a quiet capture from a connection that has silently died.
+const heartbeatInterval = 15 * time.Second
+
+// writeTimeout is how long a web client can take to receive a record before the connection is given up.
+const writeTimeout = 10 * time.Second
+
+// messagesHandler streams the captured records to a web client over a websocket.
+//
+// The query parameter "after" resumes a stream: only the records after the given message ID are sent,
+// preceded by the capture header and the descriptors. A heartbeat record is sent when there is nothing else to send.
+// The query parameter "filter" is a CEL expression over the fields of the records: only the matching records are sent.
+// The filter can be checked beforehand with the query API, see filterHandler.
+// A client that falls behind the capture is disconnected after the records already queued for it,
+// so that it can resume after them when it reconnects.
 func (v *GrpcWebViewer) messagesHandler(w http.ResponseWriter, r *http.Request) {
-	sock, err := websocket.Accept(w, r, nil)
-	if err != nil {
+	var after int64
+	if s := r.URL.Query().Get("after"); s != "" {
+		var err error
+		after, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || after < 0 {
+			http.Error(w, "Invalid message ID: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	filter, ok := parseFilterParam(w, r.URL.Query().Get("filter"))
+	if !ok {
 		return
 	}
-	defer sock.CloseNow() // nolint:errcheck
 
-	messagesFile, err := os.OpenFile(v.messages, os.O_RDONLY, 0)
+	v.sessions.Add(1)
+	defer v.sessions.Done()
+
+	sock, err := websocket.Accept(w, r, nil)
 	if err != nil {
-		sock.Close(websocket.StatusInternalError, "Capture messages file not found") //nolint:errcheck
 		return
 	}
-	defer messagesFile.Close() //nolint:errcheck
+	defer sock.CloseNow() // nolint:errcheck
 
-	tailCtx, cancelTail := context.WithCancel(context.Background())
-	defer cancelTail()
-	messages := make(chan string)
-	go tailFile(tailCtx, messagesFile, messages)
+	ctx, cancel := context.WithCancel(v.ctx)
+	defer cancel()
 
 	// The web client will never write anything to the socket.
 	// If read returns, the client has disconnected.
 	go func() {
 		_, _, _ = sock.Reader(r.Context())
-		cancelTail()
+		cancel()
 	}()
 
+	snapshot, sub, err := v.hub.subscribe(ctx, after)
+	if err != nil {
+		v.closeSession(sock, ctx, nil)
+		return
+	}
+	defer v.hub.unsubscribe(sub)
+
+	for _, msg := range snapshot {
+		if filter != nil && !filter.match(msg) {
+			continue
+		}
+		if err := writeRecord(ctx, sock, []byte(msg)); err != nil {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
 	for {
 		select {
-		case msg, ok := <-messages:
+		case msg, ok := <-sub.records:
 			if !ok {
-				fmt.Println("Messages channel closed")
+				v.closeSession(sock, ctx, sub)
 				return
 			}
-			if err := sock.Write(tailCtx, websocket.MessageText, []byte(msg)); err != nil {
+			if filter != nil && !filter.match(msg) {
+				continue
+			}
+			if err := writeRecord(ctx, sock, []byte(msg)); err != nil {
 				return
 			}
-		case <-tailCtx.Done():
-			sock.Close(websocket.StatusInternalError, "Cannot read captured messages from file") //nolint:errcheck
+			heartbeat.Reset(heartbeatInterval)
+		case <-heartbeat.C:
+			msg, _ := json.Marshal(struct {
+				Type recordType `json:"type"`
+				Time string     `json:"time"`
+			}{
+				Type: recordHeartbeat,
+				Time: time.Now().Format(time.RFC3339Nano),
+			})
+			if err := writeRecord(ctx, sock, msg); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			v.closeSession(sock, ctx, sub)
+			return
+		}
+	}
+}
+
+// writeRecord sends a record to the web client, giving up if the client does not receive it in time.
+func writeRecord(ctx context.Context, sock *websocket.Conn, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	return sock.Write(ctx, websocket.MessageText, msg)
+}
+
+// closeSession closes the websocket connection when the captured messages are no longer sent to it.
+// The subscriber is nil if the connection is closed before subscribing.
+func (v *GrpcWebViewer) closeSession(sock *websocket.Conn, ctx context.Context, sub *subscriber) {
+	switch {
+	case v.ctx.Err() != nil:
+		sock.Close(websocket.StatusGoingAway, "Viewer is shutting down") //nolint:errcheck
+	case sub != nil && v.hub.disconnectedSlow(sub):
+		sock.Close(websocket.StatusTryAgainLater, "Client is too slow to receive the captured messages") //nolint:errcheck
+	case ctx.Err() != nil:
+		// The client has disconnected.
+	default:
+		sock.Close(websocket.StatusInternalError, "Cannot read captured messages from file") //nolint:errcheck
+	}
+}
+
+// downloadHandler returns the captured records as a JSON Lines file.
+// The records are read from the ring, or from the current capture file, which starts with the capture header
+// even when rotated.
+func (v *GrpcWebViewer) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filename := "grpc_capture.jsonl"
+	var records io.Reader
+	if v.ring != nil {
+		var buf bytes.Buffer
+		_, _ = v.ring.WriteTo(&buf)
+		records = &buf
+	} else {
+		file, err := os.Open(v.messages)
+		if err != nil {
+			http.Error(w, "Capture messages file not found", http.StatusNotFound)
 			return
 		}
+		defer file.Close() //nolint:errcheck
+		filename = filepath.Base(v.messages)
+		records = file
 	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, records)
+}
+
+// configHandler returns the configuration of the web interface.
+func (v *GrpcWebViewer) configHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		TraceURL string `json:"trace_url,omitempty"`
+	}{
+		TraceURL: v.options.TraceURL,
+	})
 }
 
 func (v *GrpcWebViewer) filesHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,176 @@
+package grpc_json_sniffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func serve(t *testing.T, v *GrpcWebViewer, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestDownloadRing(t *testing.T) {
+	ring := NewRingSink(100, 0)
+	i, _ := newTestInterceptor(t, WithSink(ring))
+	serverOptions, _ := interceptorOptions(i, sideServer)
+	conn, _ := startTestServer(t, serverOptions)
+	for _, kind := range callKinds {
+		if err := kind.invoke(t.Context(), conn); err != nil {
+			t.Fatalf("%s: %v", kind.name, err)
+		}
+	}
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewRingWebViewer("", ring)
+	defer v.Shutdown(t.Context()) //nolint:errcheck
+
+	rec := serve(t, v, http.MethodGet, "/download")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "application/jsonl"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Disposition"), "attachment; filename=grpc_capture.jsonl"; got != want {
+		t.Errorf("got Content-Disposition %q, want %q", got, want)
+	}
+
+	// The download is a capture file like any other: it starts with the header,
+	// and the types of the messages are defined before they are used.
+	filename := filepath.Join(t.TempDir(), "grpc_capture.jsonl")
+	if err := os.WriteFile(filename, rec.Body.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := readCaptureFile(t, filename)
+	if len(f.records) == 0 || f.records[0] != string(recordCapture) {
+		t.Fatalf("got records %q, want the capture header first", f.records)
+	}
+	if len(f.defined) == 0 {
+		t.Errorf("got no message records in %q", f.records)
+	}
+	if len(f.unknown) != 0 {
+		t.Errorf("got messages %q without descriptors", f.unknown)
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "capture.json")
+	content := "{\"type\":\"capture\"}\n{\"type\":\"message\"}\n"
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v := NewGrpcWebViewer("", filename)
+	defer v.Shutdown(t.Context()) //nolint:errcheck
+	missing := NewGrpcWebViewer("", filepath.Join(t.TempDir(), "missing.json"))
+	defer missing.Shutdown(t.Context()) //nolint:errcheck
+
+	tests := []struct {
+		name        string
+		viewer      *GrpcWebViewer
+		method      string
+		wantStatus  int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "get",
+			viewer:     v,
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+			wantHeaders: map[string]string{
+				"Content-Type":        "application/jsonl",
+				"Content-Disposition": "attachment; filename=capture.json",
+			},
+		},
+		{
+			name:       "head",
+			viewer:     v,
+			method:     http.MethodHead,
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Content-Type":        "application/jsonl",
+				"Content-Disposition": "attachment; filename=capture.json",
+			},
+		},
+		{
+			name:        "post",
+			viewer:      v,
+			method:      http.MethodPost,
+			wantStatus:  http.StatusMethodNotAllowed,
+			wantBody:    "Method not allowed\n",
+			wantHeaders: map[string]string{"Allow": "GET, HEAD"},
+		},
+		{
+			name:       "missing file",
+			viewer:     missing,
+			method:     http.MethodGet,
+			wantStatus: http.StatusNotFound,
+			wantBody:   "Capture messages file not found\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, tt.viewer, tt.method, "/download")
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("got body %q, want %q", got, tt.wantBody)
+			}
+			for key, want := range tt.wantHeaders {
+				if got := rec.Header().Get(key); got != want {
+					t.Errorf("got %s %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesHandler(t *testing.T) {
+	v := NewGrpcWebViewer("", "")
+	defer v.Shutdown(t.Context()) //nolint:errcheck
+
+	tests := []struct {
+		path            string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			path:            "/",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/html",
+			wantBody:        "<html",
+		},
+		{
+			path:            "/missing.html",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "text/plain",
+			wantBody:        "File not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(t, v, http.MethodGet, tt.path)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("got Content-Type %q, want %q", got, tt.wantContentType)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("got body %q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// OverflowPolicy decides what happens to a captured message when the capture queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the RPC until there is room in the queue.
+	// No messages are lost, but a slow sink slows down the gRPC calls.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the message that did not fit into the queue.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued message to make room for the new one.
+	OverflowDropOldest
+)
+
+const defaultQueueSize = 1024
+
+// CaptureStats holds the counters of the capture writer.
+type CaptureStats struct {
+	Written uint64 `json:"written"` // Messages written to the sink.
+	Dropped uint64 `json:"dropped"` // Messages dropped because the queue was full.
+	Failed  uint64 `json:"failed"`  // Messages that could not be encoded or written to the sink.
+}
+
+// captureWriter writes captured messages to the sink in a background goroutine.
+//
+// Message IDs are assigned in the same critical section that puts the message into the queue,
+// so the messages reach the sink whole and in message ID order, even when captured concurrently.
+type captureWriter struct {
+	mu        sync.Mutex
+	messageId int64 // Unique identifier for each message.
+	queue     chan *capturedMessage
+	policy    OverflowPolicy
+	sink      Sink
+	closed    bool // Messages captured after closing are discarded.
+	closeOnce sync.Once
+	done      chan struct{} // Closed when the background goroutine has written all messages and closed the sink.
+	closeErr  error
+
+	// Flush waits until the number of processed messages reaches the number of queued messages.
+	progress  sync.Mutex
+	processed sync.Cond
+	queued    uint64 // Messages put into the queue.
+	finished  uint64 // Messages written, failed or removed from the queue.
+
+	// Descriptors of the message types written so far, and the process that writes the capture.
+	// They are used only by the background goroutine.
+	descriptors *descriptorSet
+	process     processInfo
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+func newCaptureWriter(sink Sink, queueSize int, policy OverflowPolicy) *captureWriter {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	w := &captureWriter{
+		queue:       make(chan *capturedMessage, queueSize),
+		policy:      policy,
+		sink:        sink,
+		done:        make(chan struct{}),
+		descriptors: newDescriptorSet(),
+		process:     newProcessInfo(),
+	}
+	w.processed.L = &w.progress
+	// Sinks that start new files repeat the header at the start of each file.
+	if s, ok := sink.(headerSink); ok {
+		s.setHeader(w.header)
+	}
+	go w.run()
+	return w
+}
+
+// enqueue assigns the message ID and timestamp to the message and queues it for writing.
+// Messages that were held back before writing already have their timestamp.
+func (w *captureWriter) enqueue(m *capturedMessage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+
+	w.messageId++
+	m.MessageId = w.messageId
+	if m.Time == "" {
+		m.Time = time.Now().Format(time.RFC3339Nano)
+	}
+
+	switch w.policy {
+	case OverflowDropNewest:
+		select {
+		case w.queue <- m:
+			w.addQueued()
+		default:
+			w.dropped.Add(1)
+		}
+	case OverflowDropOldest:
+		select {
+		case w.queue <- m:
+			w.addQueued()
+		default:
+			// Only the goroutine holding the lock sends to the queue,
+			// so after removing the oldest message there is room for the new one.
+			select {
+			case <-w.queue:
+				w.dropped.Add(1)
+				w.addFinished()
+			default:
+			}
+			w.queue <- m
+			w.addQueued()
+		}
+	default:
+		w.queue <- m
+		w.addQueued()
+	}
+}
+
+func (w *captureWriter) addQueued() {
+	w.progress.Lock()
+	defer w.progress.Unlock()
+	w.queued++
+}
+
+func (w *captureWriter) addFinished() {
+	w.progress.Lock()
+	defer w.progress.Unlock()
+	w.finished++
+	w.processed.Broadcast()
+}
+
+// flush waits until the messages queued before the call have been written to the sink.
+// If the sink implements Flush() error, it is flushed as well.
+func (w *captureWriter) flush() error {
+	w.progress.Lock()
+	target := w.queued
+	for w.finished < target {
+		w.processed.Wait()
+	}
+	w.progress.Unlock()
+
+	// The lock keeps the sink open while it is flushed, it is closed only after the queue.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	if f, ok := w.sink.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// close stops accepting new messages, waits for the queued messages to be written, and closes the sink.
+// If the context expires first, the remaining messages are still written and the sink is closed in the background.
+func (w *captureWriter) close(ctx context.Context) error {
+	w.closeOnce.Do(func() {
+		// Sending to the queue may block while holding the lock, so the queue is closed in the background.
+		go func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.closed = true
+			close(w.queue)
+		}()
+	})
+
+	select {
+	case <-w.done:
+		return w.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *captureWriter) run() {
+	if header, err := w.header(); err == nil {
+		_ = w.writePinned(header)
+	}
+
+	for m := range w.queue {
+		// The descriptors of new message types are written before the first record using them.
+		if files := w.descriptors.add(m.types()); len(files) > 0 {
+			if record, err := w.descriptorsRecord(files); err == nil {
+				_ = w.writePinned(record)
+			}
+		}
+
+		w.write(m)
+		w.addFinished()
+	}
+
+	w.closeErr = w.sink.Close()
+	close(w.done)
+}
+
+// writePinned writes the capture header or a descriptors record, which sinks discarding old records must keep.
+func (w *captureWriter) writePinned(record []byte) error {
+	if s, ok := w.sink.(pinningSink); ok {
+		return s.writePinned(record)
+	}
+	return w.sink.Write(record)
+}
+
+func (w *captureWriter) write(m *capturedMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		w.failed.Add(1)
+		return
+	}
+	if err := w.sink.Write(data); err != nil {
+		w.failed.Add(1)
+		return
+	}
+	w.written.Add(1)
+}
+
+// header returns the capture header, with the descriptors of all message types written so far.
+func (w *captureWriter) header() ([]byte, error) {
+	h := captureHeader{
+		Type:          recordCapture,
+		FormatVersion: captureFormatVersion,
+		Time:          time.Now().Format(time.RFC3339Nano),
+		Process:       w.process,
+	}
+	if len(w.descriptors.all) > 0 {
+		descriptors, err := marshalDescriptors(w.descriptors.all)
+		if err != nil {
+			return nil, err
+		}
+		h.Descriptors = descriptors
+	}
+	return json.Marshal(h)
+}
+
+func (w *captureWriter) descriptorsRecord(files []*descriptorpb.FileDescriptorProto) ([]byte, error) {
+	descriptors, err := marshalDescriptors(files)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(descriptorsRecord{
+		Type:        recordDescriptors,
+		Time:        time.Now().Format(time.RFC3339Nano),
+		Descriptors: descriptors,
+	})
+}
+
+func (w *captureWriter) stats() CaptureStats {
+	return CaptureStats{
+		Written: w.written.Load(),
+		Dropped: w.dropped.Load(),
+		Failed:  w.failed.Load(),
+	}
+}
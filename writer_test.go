@@ -0,0 +1,169 @@
+package grpc_json_sniffer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingSink holds every write until it is unblocked.
+type blockingSink struct {
+	MemorySink
+	unblock chan struct{}
+	closed  atomic.Bool
+}
+
+func newBlockingSink() *blockingSink {
+	return &blockingSink{unblock: make(chan struct{})}
+}
+
+func (s *blockingSink) Write(record []byte) error {
+	<-s.unblock
+	return s.MemorySink.Write(record)
+}
+
+func (s *blockingSink) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+// messageIds returns the IDs of the message records written to the sink.
+func messageIds(t *testing.T, sink *blockingSink) []int64 {
+	t.Helper()
+	var ids []int64
+	for _, line := range sink.Records() {
+		var m capturedMessage
+		if err := json.Unmarshal(line, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Type == recordMessage {
+			ids = append(ids, m.MessageId)
+		}
+	}
+	return ids
+}
+
+// returnsWithin tells whether f returns before the timeout.
+func returnsWithin(timeout time.Duration, f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestCaptureWriterOverflow(t *testing.T) {
+	tests := []struct {
+		policy      OverflowPolicy
+		wantIds     []int64
+		wantDropped uint64
+	}{
+		{OverflowDropNewest, []int64{1, 2}, 3},
+		{OverflowDropOldest, []int64{4, 5}, 3},
+	}
+	for _, tt := range tests {
+		sink := newBlockingSink()
+		w := newCaptureWriter(sink, 2, tt.policy)
+
+		// The writer is stuck writing the capture header, so the queue fills up.
+		if !returnsWithin(time.Second, func() {
+			for range 5 {
+				w.enqueue(&capturedMessage{Type: recordMessage})
+			}
+		}) {
+			t.Fatalf("policy %d: enqueue blocked", tt.policy)
+		}
+		if got := w.stats().Dropped; got != tt.wantDropped {
+			t.Errorf("policy %d: got %d dropped, want %d", tt.policy, got, tt.wantDropped)
+		}
+
+		close(sink.unblock)
+		// Flush must not wait for the dropped messages.
+		if !returnsWithin(time.Second, func() { _ = w.flush() }) {
+			t.Fatalf("policy %d: flush did not return", tt.policy)
+		}
+		if got := messageIds(t, sink); !reflect.DeepEqual(got, tt.wantIds) {
+			t.Errorf("policy %d: got message IDs %v, want %v", tt.policy, got, tt.wantIds)
+		}
+		if got := w.stats(); got.Written != uint64(len(tt.wantIds)) || got.Failed != 0 {
+			t.Errorf("policy %d: got stats %+v", tt.policy, got)
+		}
+		if err := w.close(context.Background()); err != nil || !sink.closed.Load() {
+			t.Errorf("policy %d: close returned %v, sink closed %v", tt.policy, err, sink.closed.Load())
+		}
+	}
+}
+
+func TestCaptureWriterOverflowBlock(t *testing.T) {
+	sink := newBlockingSink()
+	w := newCaptureWriter(sink, 2, OverflowBlock)
+
+	enqueued := make(chan struct{})
+	go func() {
+		defer close(enqueued)
+		for range 5 {
+			w.enqueue(&capturedMessage{Type: recordMessage})
+		}
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("enqueue did not block while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sink.unblock)
+	<-enqueued
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIds(t, sink); !reflect.DeepEqual(got, []int64{1, 2, 3, 4, 5}) {
+		t.Errorf("got message IDs %v, want all", got)
+	}
+	if got := w.stats(); got.Written != 5 || got.Dropped != 0 {
+		t.Errorf("got stats %+v", got)
+	}
+}
+
+func TestCaptureWriterClose(t *testing.T) {
+	sink := newBlockingSink()
+	w := newCaptureWriter(sink, 2, OverflowDropOldest)
+	for range 5 {
+		w.enqueue(&capturedMessage{Type: recordMessage})
+	}
+
+	// The context expires while the sink is blocked, the queue is still written in the background.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(sink.unblock)
+	if err := w.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !sink.closed.Load() {
+		t.Error("sink was not closed")
+	}
+	if got := messageIds(t, sink); !reflect.DeepEqual(got, []int64{4, 5}) {
+		t.Errorf("got message IDs %v, want the newest", got)
+	}
+
+	// Messages captured after closing are discarded, and flushing does not wait for them.
+	w.enqueue(&capturedMessage{Type: recordMessage})
+	if !returnsWithin(time.Second, func() { _ = w.flush() }) {
+		t.Fatal("flush after close did not return")
+	}
+	if got := w.stats(); got.Written != 2 || got.Dropped != 3 {
+		t.Errorf("got stats %+v", got)
+	}
+}